@@ -0,0 +1,66 @@
+package diagnose
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/rancher/rancherd/pkg/cacerts"
+	cli "github.com/rancher/wrangler-cli"
+	"github.com/spf13/cobra"
+)
+
+func NewDiagnose() *cobra.Command {
+	return cli.Command(&Diagnose{}, cobra.Command{
+		Short: "Check reachability, token and CA certs of a Rancher server",
+	})
+}
+
+type Diagnose struct {
+	Server string `usage:"Rancher server URL"`
+	Token  string `usage:"Cluster registration token"`
+	JSON   bool   `name:"json" usage:"Print the results as JSON"`
+}
+
+func (d *Diagnose) Run(cmd *cobra.Command, args []string) error {
+	if d.Server == "" || d.Token == "" {
+		return fmt.Errorf("--server and --token are required")
+	}
+
+	result, err := cacerts.Diagnose(cmd.Context(), d.Server, d.Token)
+	if err != nil {
+		return err
+	}
+
+	if d.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	printCheck("reachable", result.Reachable)
+	printCheck("token", result.Token)
+	printCheck("cacerts", result.CACerts)
+	printCheck("expiry", result.Expiry)
+	if result.AlreadyTrusted {
+		fmt.Println("server is trusted by the system roots")
+	}
+	if result.Checksum != "" {
+		fmt.Printf("checksum: %s\n", result.Checksum)
+	}
+	for _, cert := range result.Certificates {
+		fmt.Printf("certificate: %s (expires %s) %s\n", cert.Subject, cert.NotAfter, cert.Fingerprint)
+	}
+	return nil
+}
+
+func printCheck(name string, check cacerts.CheckResult) {
+	switch {
+	case check.Skipped:
+		fmt.Printf("%s: skipped\n", name)
+	case check.OK:
+		fmt.Printf("%s: ok\n", name)
+	default:
+		fmt.Printf("%s: failed: %s\n", name, check.Error)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/rancher/rancherd/cmd/rancherd/bootstrap"
+	"github.com/rancher/rancherd/cmd/rancherd/diagnose"
 	"github.com/rancher/rancherd/cmd/rancherd/gettoken"
 	"github.com/rancher/rancherd/cmd/rancherd/gettpmhash"
 	"github.com/rancher/rancherd/cmd/rancherd/info"
@@ -36,6 +37,7 @@ func main() {
 		info.NewInfo(),
 		gettpmhash.NewGetTPMHash(),
 		updateclientsecret.NewUpdateClientSecret(),
+		diagnose.NewDiagnose(),
 	)
 	cli.Main(root)
 }
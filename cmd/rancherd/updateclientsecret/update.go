@@ -15,8 +15,12 @@ func NewUpdateClientSecret() *cobra.Command {
 
 type UpdateClientSecret struct {
 	Kubeconfig string `usage:"Kubeconfig file" env:"KUBECONFIG"`
+	DryRun     bool   `usage:"Print the changes instead of updating the secret"`
 }
 
 func (s *UpdateClientSecret) Run(cmd *cobra.Command, args []string) error {
-	return rancher.UpdateClientSecret(cmd.Context(), &rancher.Options{Kubeconfig: s.Kubeconfig})
+	return rancher.UpdateClientSecret(cmd.Context(), &rancher.Options{
+		Kubeconfig: s.Kubeconfig,
+		DryRun:     s.DryRun,
+	})
 }
@@ -0,0 +1,111 @@
+package cacerts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+)
+
+// BootstrapOptions configures BootstrapTrust.
+type BootstrapOptions struct {
+	// Server is the Rancher server, as a URL or a bare host. Required.
+	Server string
+	// Token is the cluster registration token, or the machine token if
+	// Machine is set. A machine token of the form tpm://... is resolved
+	// through the TPM, see Options.TPMFallback and Options.ForceBearer. It
+	// may also be a file, see TokenFromFile. Required.
+	Token string
+	// Machine makes BootstrapTrust download the CA with a machine token from
+	// the machine cacerts path instead of the cluster token path.
+	Machine bool
+	// Fingerprint pins the CA to a fingerprint distributed out of band, see
+	// VerifyCACerts for the accepted formats. It overrides the CAFingerprint
+	// of Options. Without it the CA is only as trusted as the token.
+	Fingerprint string
+	// Distro selects the trust store the CA is installed into. It is
+	// detected from /etc/os-release if empty, falling back to FallbackDistro
+	// like ToTrustPlan, see DetectDistro.
+	Distro Distro
+	// Options tunes the download itself, nil for the defaults. It is not
+	// modified.
+	Options *Options
+}
+
+// BootstrapResult is what BootstrapTrust found and the plan installing it.
+type BootstrapResult struct {
+	// Plan holds the trust anchor file followed by the instruction refreshing
+	// the trust store, in the order they must be applied. It is empty if the
+	// server is already trusted.
+	Plan           applyinator.Plan
+	Distro         Distro
+	Checksum       string
+	AlreadyTrusted bool
+	// TPM is set if the machine token was resolved through the TPM.
+	TPM bool
+}
+
+// BootstrapTrust is the recommended way to make a node trust a Rancher
+// server. It resolves the token, downloads and verifies the CA, detects the
+// distro if needed and returns the files and instructions installing the CA,
+// so none of the steps can be forgotten. CACerts, ToFile and
+// ToUpdateCACertificatesInstruction remain available for anything else.
+func BootstrapTrust(ctx context.Context, bootstrap BootstrapOptions) (*BootstrapResult, error) {
+	if bootstrap.Server == "" || bootstrap.Token == "" {
+		return nil, fmt.Errorf("server and token are required")
+	}
+
+	var opts Options
+	if bootstrap.Options != nil {
+		opts = *bootstrap.Options
+	}
+	if bootstrap.Fingerprint != "" {
+		opts.CAFingerprint = bootstrap.Fingerprint
+	}
+
+	distro := bootstrap.Distro
+	if distro == "" {
+		distro = detectDistroOrFallback()
+	}
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := resolveFileToken(bootstrap.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BootstrapResult{
+		Distro: distro,
+	}
+	if bootstrap.Machine {
+		result.TPM, token, err = resolveToken(ctx, token, &opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ca, err := CACertsResult(ctx, bootstrap.Server, token, !bootstrap.Machine, &opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Checksum = ca.Checksum
+	result.AlreadyTrusted = ca.AlreadyTrusted
+	if len(ca.CACert) == 0 {
+		return result, nil
+	}
+
+	// The plan is built like ToTrustPlan's, honoring AnchorPath,
+	// AnchorPermissions and UpdateTrustStore
+	file, err := opts.anchorFile(store, ca.CACert)
+	if err != nil {
+		return nil, err
+	}
+	result.Plan.Files = append(result.Plan.Files, *file)
+	if opts.AnchorPath == "" || opts.UpdateTrustStore {
+		result.Plan.Instructions = append(result.Plan.Instructions, *store.toInstruction())
+	}
+	return result, nil
+}
@@ -0,0 +1,227 @@
+package cacerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultMaxBundleSize is the largest CA bundle, in bytes, that will be parsed.
+	DefaultMaxBundleSize = 1 << 20
+	// DefaultMaxBundleCerts is the largest number of PEM blocks that will be parsed
+	// out of a CA bundle.
+	DefaultMaxBundleCerts = 256
+)
+
+func (o *Options) maxBundleSize() int {
+	if o == nil || o.MaxBundleSize <= 0 {
+		return DefaultMaxBundleSize
+	}
+	return o.MaxBundleSize
+}
+
+func (o *Options) maxBundleCerts() int {
+	if o == nil || o.MaxBundleCerts <= 0 {
+		return DefaultMaxBundleCerts
+	}
+	return o.MaxBundleCerts
+}
+
+// checkBundleLimits refuses CA bundles that are too large or hold too many PEM
+// blocks before they are handed to the x509 parser.
+func checkBundleLimits(cacert []byte, opts *Options) error {
+	if len(cacert) > opts.maxBundleSize() {
+		return fmt.Errorf("CA bundle of %d bytes exceeds the limit of %d bytes", len(cacert), opts.maxBundleSize())
+	}
+
+	count := 0
+	for rest := cacert; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		count++
+		if count > opts.maxBundleCerts() {
+			return fmt.Errorf("CA bundle exceeds the limit of %d certificates", opts.maxBundleCerts())
+		}
+	}
+	return nil
+}
+
+// ParseBundle parses every certificate of a PEM bundle, failing on PEM blocks
+// that are not certificates or if there are no certificates at all, like when
+// an HTML error page was served instead of the CA.
+func ParseBundle(pem []byte) ([]*x509.Certificate, error) {
+	return parseCertificates(pem, nil)
+}
+
+// parseCertificates parses every certificate of a PEM bundle within the limits
+// of opts.
+func parseCertificates(cacert []byte, opts *Options) ([]*x509.Certificate, error) {
+	if err := checkBundleLimits(cacert, opts); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for rest := cacert; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("PEM block %d is a %s, not a CERTIFICATE", len(certs)+1, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %d: %w", len(certs)+1, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// Bundle is a downloaded CA bundle in both raw and parsed form.
+type Bundle struct {
+	PEM          []byte
+	Checksum     string
+	Certificates []*x509.Certificate
+	// AlreadyTrusted is set when the server is trusted by the system roots, in
+	// which case PEM and Certificates are empty. They are also empty without
+	// AlreadyTrusted if the server verifiably serves no CA.
+	AlreadyTrusted bool
+}
+
+// CACertsBundle is CACerts returning the parsed certificates along with the
+// raw PEM and its checksum.
+func CACertsBundle(ctx context.Context, server, token string, clusterToken bool, opts *Options) (*Bundle, error) {
+	result, err := CACertsResult(ctx, server, token, clusterToken, opts)
+	if err != nil {
+		return nil, err
+	}
+	cacert, checksum := result.CACert, result.Checksum
+
+	if len(cacert) == 0 {
+		return &Bundle{
+			PEM:            []byte{},
+			Certificates:   []*x509.Certificate{},
+			AlreadyTrusted: result.AlreadyTrusted,
+		}, nil
+	}
+
+	certs, err := parseCertificates(cacert, opts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cacerts from %s: %w", server, err)
+	}
+
+	return &Bundle{
+		PEM:          cacert,
+		Checksum:     checksum,
+		Certificates: certs,
+	}, nil
+}
+
+// CanonicalBundle re-encodes a PEM bundle with duplicate certificates removed
+// and every certificate ahead of its issuer, so roots come last. Certificates
+// at the same distance from a root are ordered by SHA-256 fingerprint, the
+// result only depends on the set of certificates and not on their order.
+func CanonicalBundle(cacert []byte) ([]byte, error) {
+	certs, err := ParseBundle(cacert)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		unique       []*x509.Certificate
+		seen         = map[string]bool{}
+		fingerprints = map[*x509.Certificate]string{}
+	)
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+		fingerprints[cert] = fingerprint
+		unique = append(unique, cert)
+	}
+
+	depths := map[*x509.Certificate]int{}
+	for _, cert := range unique {
+		depths[cert] = issuerDepth(cert, unique)
+	}
+	sort.Slice(unique, func(i, j int) bool {
+		if depths[unique[i]] != depths[unique[j]] {
+			return depths[unique[i]] > depths[unique[j]]
+		}
+		return fingerprints[unique[i]] < fingerprints[unique[j]]
+	})
+
+	var result bytes.Buffer
+	for _, cert := range unique {
+		if err := pem.Encode(&result, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+	return result.Bytes(), nil
+}
+
+// issuerDepth counts the issuers of cert found in certs up to a root, or up
+// to a certificate whose issuer is not in the bundle.
+func issuerDepth(cert *x509.Certificate, certs []*x509.Certificate) int {
+	depth := 0
+	// The bound keeps a cross signed loop from running forever
+	for ; depth < len(certs); depth++ {
+		issuer := findIssuer(cert, certs)
+		if issuer == nil || issuer == cert {
+			break
+		}
+		cert = issuer
+	}
+	return depth
+}
+
+// VerifyCACerts checks cacert against a fingerprint distributed out of band.
+// expectedFingerprint is either the SHA-256 of the whole PEM bundle, which is
+// the CA checksum Rancher displays, or the SHA-256 of the DER of the first
+// certificate of the bundle, as printed by openssl x509 -fingerprint -sha256.
+// Hex digits may be in either case and separated by colons.
+func VerifyCACerts(cacert []byte, expectedFingerprint string) error {
+	expected := normalizeFingerprint(expectedFingerprint)
+	if expected == "" {
+		return fmt.Errorf("no fingerprint to verify CA certs against")
+	}
+	if len(cacert) == 0 {
+		return fmt.Errorf("no CA certs to verify against fingerprint %s", expectedFingerprint)
+	}
+
+	if hashHex(cacert) == expected {
+		return nil
+	}
+
+	if block, _ := pem.Decode(cacert); block != nil && block.Type == "CERTIFICATE" {
+		sum := sha256.Sum256(block.Bytes)
+		if hex.EncodeToString(sum[:]) == expected {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("CA certs with checksum %s do not match the pinned fingerprint %s", hashHex(cacert), expectedFingerprint)
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
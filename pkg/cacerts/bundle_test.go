@@ -0,0 +1,247 @@
+package cacerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for a test along with its key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert signs template with parent, or self-signs it if parent is nil.
+// Unset validity defaults to an hour before now until a day after.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	cert, err := generateTestCert(template, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// generateTestCert is newTestCert for callers without a testing.T.
+func generateTestCert(template *x509.Certificate, parent *testCert) (*testCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	template.BasicConstraintsValid = true
+	if template.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage |= x509.KeyUsageDigitalSignature
+		if template.ExtKeyUsage == nil {
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// newTestCA returns a self-signed CA named name.
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: name},
+		IsCA:    true,
+	}, nil)
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.cert.Raw},
+		PrivateKey:  c.key,
+		Leaf:        c.cert,
+	}
+}
+
+func TestVerifyCACerts(t *testing.T) {
+	root := newTestCA(t, "root")
+	intermediate := newTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "intermediate"},
+		IsCA:    true,
+	}, root)
+	bundle := append(append([]byte{}, intermediate.pem...), root.pem...)
+
+	leafSum := sha256.Sum256(intermediate.cert.Raw)
+	var opensslFingerprint []string
+	for _, b := range leafSum {
+		opensslFingerprint = append(opensslFingerprint, fmt.Sprintf("%02X", b))
+	}
+
+	// Flip a single bit in the middle of the base64 of the first certificate
+	tampered := append([]byte{}, bundle...)
+	tampered[len(intermediate.pem)/2] ^= 1
+
+	tests := []struct {
+		name        string
+		cacert      []byte
+		fingerprint string
+		wantErr     bool
+	}{
+		{
+			name:        "bundle checksum",
+			cacert:      bundle,
+			fingerprint: hashHex(bundle),
+		},
+		{
+			name:        "bundle checksum in upper case",
+			cacert:      bundle,
+			fingerprint: strings.ToUpper(hashHex(bundle)),
+		},
+		{
+			name:        "leaf fingerprint as printed by openssl",
+			cacert:      bundle,
+			fingerprint: strings.Join(opensslFingerprint, ":"),
+		},
+		{
+			name:        "leaf fingerprint without colons",
+			cacert:      bundle,
+			fingerprint: fmt.Sprintf("%x", leafSum),
+		},
+		{
+			name:        "fingerprint of another certificate",
+			cacert:      bundle,
+			fingerprint: hashHex(root.cert.Raw),
+			wantErr:     true,
+		},
+		{
+			name:        "tampered bundle",
+			cacert:      tampered,
+			fingerprint: hashHex(bundle),
+			wantErr:     true,
+		},
+		{
+			name:        "tampered bundle against the leaf fingerprint",
+			cacert:      tampered,
+			fingerprint: strings.Join(opensslFingerprint, ":"),
+			wantErr:     true,
+		},
+		{
+			name:        "fingerprint with an algorithm prefix",
+			cacert:      bundle,
+			fingerprint: "sha256:" + hashHex(bundle),
+			wantErr:     true,
+		},
+		{
+			name:        "truncated fingerprint",
+			cacert:      bundle,
+			fingerprint: hashHex(bundle)[:32],
+			wantErr:     true,
+		},
+		{
+			name:        "empty fingerprint",
+			cacert:      bundle,
+			fingerprint: " ",
+			wantErr:     true,
+		},
+		{
+			name:        "empty bundle",
+			fingerprint: hashHex(bundle),
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyCACerts(tt.cacert, tt.fingerprint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyCACerts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCanonicalBundle(t *testing.T) {
+	root := newTestCA(t, "root")
+	other := newTestCA(t, "other root")
+	intermediate := newTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "intermediate"},
+		IsCA:    true,
+	}, root)
+	leaf := newTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "leaf"},
+		IsCA:    true,
+	}, intermediate)
+
+	join := func(certs ...*testCert) []byte {
+		var bundle []byte
+		for _, cert := range certs {
+			bundle = append(bundle, cert.pem...)
+		}
+		return bundle
+	}
+	bundles := [][]byte{
+		join(leaf, intermediate, root, other),
+		join(root, other, intermediate, leaf),
+		join(other, intermediate, root, leaf, intermediate),
+		join(root, leaf, root, other, intermediate, leaf),
+	}
+
+	want, err := CanonicalBundle(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ParseBundle(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 4 {
+		t.Fatalf("CanonicalBundle() returned %d certificates, want 4", len(certs))
+	}
+	// Roots come last, in fingerprint order
+	if !certs[0].Equal(leaf.cert) || !certs[1].Equal(intermediate.cert) {
+		t.Errorf("CanonicalBundle() starts with %q and %q, want leaf and intermediate", certs[0].Subject.CommonName, certs[1].Subject.CommonName)
+	}
+
+	for i, bundle := range bundles[1:] {
+		got, err := CanonicalBundle(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashHex(got) != hashHex(want) {
+			t.Errorf("CanonicalBundle() of bundle %d has checksum %s, want %s", i+1, hashHex(got), hashHex(want))
+		}
+	}
+}
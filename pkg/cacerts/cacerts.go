@@ -1,163 +1,755 @@
 package cacerts
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/sha512"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	url2 "net/url"
+	"strings"
 	"time"
 
 	"github.com/rancher/rancherd/pkg/tpm"
 	"github.com/rancher/wrangler/pkg/randomtoken"
+	"github.com/sirupsen/logrus"
 )
 
-var insecureClient = &http.Client{
-	Timeout: time.Second * 5,
-	Transport: &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	},
+const (
+	// DefaultCACertsPath is where the cluster CA is served.
+	DefaultCACertsPath = "/cacerts"
+	// DefaultMachineCACertsPath is where the CA for machine tokens is served.
+	DefaultMachineCACertsPath = "/v1-rancheros/cacerts"
+)
+
+// Options tunes how the CA certs and authenticated resources are fetched. A nil
+// *Options is valid and means the defaults.
+type Options struct {
+	// Timeout of each HTTP request, both the cacerts download and the
+	// authenticated fetch. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// IncludeClusterCA makes the machine (v1-rancheros) path also download the
+	// cluster CA from /cacerts, using the same token, and return it merged with
+	// the machine CA. Identical bundles are only returned once.
+	IncludeClusterCA bool
+	// MaxBundleSize caps the size in bytes of a CA bundle that will be parsed.
+	// Defaults to DefaultMaxBundleSize.
+	MaxBundleSize int
+	// MaxBundleCerts caps the number of certificates parsed out of a CA bundle.
+	// Defaults to DefaultMaxBundleCerts.
+	MaxBundleCerts int
+	// OnEndpoint, if set, is called with every endpoint that successfully
+	// answered a request, so callers can audit where the data came from.
+	OnEndpoint func(Endpoint)
+	// MinTokenLength, if set, rejects tokens of fewer characters than this
+	// before the cacerts handshake is attempted.
+	MinTokenLength int
+	// MinTokenEntropy, if set, rejects tokens whose estimated entropy in bits is
+	// below this. See tokenEntropy for how the estimate is computed.
+	MinTokenEntropy float64
+	// RateLimitRetries is how many times a 429 response to an authenticated
+	// fetch is retried, honoring Retry-After. Defaults to
+	// DefaultRateLimitRetries, a negative value disables retrying.
+	RateLimitRetries int
+	// Digest is the hash used to verify X-Cattle-Hash. By default it is the one
+	// announced by the X-Cattle-Hash-Algorithm response header, or
+	// DefaultDigest if there is none. If set, the server must use it.
+	Digest Digest
+	// ServerName overrides the name used for SNI and certificate verification
+	// on the authenticated fetch, for proxies where it must differ from the
+	// host being dialed.
+	ServerName string
+	// ClientCertificate, or the PEM files ClientCertFile and ClientKeyFile,
+	// is presented on the authenticated fetch of Do, Get and MachineGet, for
+	// ingresses that require mutual TLS. The cacerts download never presents
+	// it.
+	ClientCertificate *tls.Certificate
+	ClientCertFile    string
+	ClientKeyFile     string
+	// DisableHTTP2 forces HTTP/1.1 on the cacerts and authenticated requests,
+	// for load balancers that leave HTTP/2 connections half closed. The
+	// transports built by this package never negotiate HTTP/2, since net/http
+	// doesn't for a transport with a custom DialContext and TLSClientConfig,
+	// so this matters for a Transport set by the caller: an *http.Transport is
+	// cloned with HTTP/2 disabled, any other RoundTripper is used as is.
+	DisableHTTP2 bool
+	// MinTLSVersion is the lowest TLS version negotiated, tls.VersionTLS12 by
+	// default. It also applies to the cacerts download, which only skips
+	// certificate verification.
+	MinTLSVersion uint16
+	// CipherSuites, if set, restricts the TLS 1.2 cipher suites, for instance
+	// to the FIPS approved ones. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+	// CheckRevocation checks the downloaded CA certs against their CRL
+	// distribution points or OCSP responders and fails if any is revoked. This
+	// needs outbound connectivity to those endpoints.
+	CheckRevocation bool
+
+	// Retry is how failed cacerts downloads are retried. Only connection errors
+	// and 5xx responses are retried, never a rejected token or hash mismatch.
+	// Defaults to DefaultRetryPolicy.
+	Retry *RetryPolicy
+	// Resolver, if set, resolves the server host instead of the system
+	// resolver, for split horizon DNS. See newTransport for how it interacts
+	// with proxies.
+	Resolver *net.Resolver
+	// ExpectedCAChecksum, if set, makes Do, Get and MachineGet fail before the
+	// authenticated request unless the CA they are about to trust has this
+	// checksum, the hex SHA-256 of the PEM bytes, the same value returned as
+	// caChecksum. A server already trusted by the system roots has no CA and
+	// never matches.
+	ExpectedCAChecksum string
+	// AnchorPath and AnchorPermissions, if set, replace the trust anchor path
+	// of the distro and the Permissions of FileDefaults in ToFile and
+	// ToTrustPlan. AnchorPath is used as is, without the PathPrefix.
+	// AnchorPermissions is an octal mode like "0644".
+	AnchorPath        string
+	AnchorPermissions string
+	// UpdateTrustStore makes ToTrustPlan still emit the update instruction of
+	// the distro with an AnchorPath, which is usually not read by it.
+	UpdateTrustStore bool
+	// CacheFile, if set, is where a verified CA is stored, with its checksum
+	// and the URL it came from in CacheFile.checksum. Later calls for the same
+	// URL return it without contacting the server, a different server or a
+	// CA that no longer matches its checksum is downloaded again.
+	CacheFile string
+	// MemoryCache keeps the CA verified by each call in memory for the rest of
+	// the process. Later calls for the same cacerts URL then return it without
+	// the X-Cattle-Hash handshake, as long as the server still presents a
+	// certificate that verifies against it, so the token is not checked
+	// again. A CA seeded by LoadCacheFromFile is used the same way without
+	// this option.
+	MemoryCache bool
+	// AllowExpired turns an expired downloaded CA certificate from an error
+	// into a warning.
+	AllowExpired bool
+	// ExpiryWarning, if set, logs a warning for downloaded CA certificates
+	// that expire within this duration.
+	ExpiryWarning time.Duration
+	// PinnedCAOnly makes the authenticated fetch trust only the downloaded CA
+	// instead of adding it to the system roots.
+	PinnedCAOnly bool
+	// VerifyAgainstServer makes CACerts connect to the server again trusting
+	// only the downloaded CA, and fail if the certificate it serves doesn't
+	// verify. It catches a correct CA served behind an ingress with another
+	// certificate. A custom Transport is not used for that connection.
+	VerifyAgainstServer bool
+	// CanonicalBundle makes CACerts return the bundle re-encoded by
+	// CanonicalBundle, deduplicated with roots last, and its checksum instead
+	// of the bytes served. CAFingerprint is still checked against the served
+	// bundle, ExpectedCAChecksum against the canonical one.
+	CanonicalBundle bool
+	// TPMFallback makes MachineGet use a tpm:// token as a plain bearer token,
+	// without the tpm:// prefix, on nodes that have no TPM device. Any other
+	// TPM failure is still returned.
+	TPMFallback bool
+	// ForceBearer makes MachineGet skip the TPM entirely and send the machine
+	// token, without any tpm:// prefix, as a plain bearer token. This drops
+	// the attestation: anyone holding the token can then register as the
+	// node, so it is only meant for debugging and nodes without a TPM by
+	// design. The cluster token path is unaffected.
+	ForceBearer bool
+	// TokenResolver, if set, resolves the machine token instead of the TPM.
+	// ForceBearer still takes precedence over it, while TPMFallback and
+	// TPMTimeout only apply to the default TPM resolution.
+	TokenResolver TokenResolver
+	// TPMTimeout bounds resolving a tpm:// token and the whole TPM attested
+	// request, so a hung TPM or resource manager fails the request instead of
+	// blocking it. Defaults to DefaultTPMTimeout.
+	TPMTimeout time.Duration
+	// CACertsPath and MachineCACertsPath override the path the CA is
+	// downloaded from with a cluster and a machine token, for servers mounted
+	// under a subpath. Default to DefaultCACertsPath and
+	// DefaultMachineCACertsPath.
+	CACertsPath        string
+	MachineCACertsPath string
+	// Transport, if set, sends every cacerts and authenticated request instead
+	// of the transports built by this package, for tests against a plain
+	// httptest.Server or to add tracing. It is then responsible for TLS, so
+	// ServerName, Resolver, Proxy and the downloaded CA are not applied, only
+	// DisableHTTP2 is.
+	Transport http.RoundTripper
+	// Header is added to every request, it may override the default
+	// User-Agent of rancherd/<version> but not the Authorization and
+	// X-Cattle-Nonce headers of the protocol.
+	Header http.Header
+	// Proxy, if set, replaces http.ProxyFromEnvironment for both the cacerts
+	// download and the authenticated fetch, use http.ProxyURL for a fixed
+	// proxy.
+	Proxy func(*http.Request) (*url2.URL, error)
+	// OnRequest, if set, is called after every request, failed or not, for
+	// telemetry per endpoint.
+	OnRequest func(Request)
+	// OnTimings, if set, is called with the duration of each phase of every
+	// successful cacerts fetch.
+	OnTimings func(Timings)
+	// OnResponseHeader, if set, is called with the headers of the cacerts
+	// response that was used, the verified download or the probe of an
+	// already trusted server, for metadata added by custom Rancher builds.
+	OnResponseHeader func(http.Header)
+	// Debug logs every request and response of the cacerts download and the
+	// authenticated fetch at debug level, with the Authorization header
+	// redacted. The TPM attestation exchange is not dumped.
+	Debug bool
+	// Metrics, if set, receives the duration, failures and retries of CACerts
+	// and Do.
+	Metrics Metrics
+
+	// CAFingerprint pins the CA certs, see VerifyCACerts for the accepted
+	// formats. Anything not matching is rejected, even if its X-Cattle-Hash is
+	// valid, and the CA is always downloaded even if the server is already
+	// trusted by the system roots.
+	CAFingerprint string
+
+	// NonceSource, if set, generates the X-Cattle-Nonce of each download
+	// instead of randomtoken.Generate, for tests that check the hash against a
+	// known response. Unlike CACertsWithNonce the trust probes still run.
+	NonceSource func() (string, error)
+
+	// fixedNonce replaces the random X-Cattle-Nonce, see CACertsWithNonce.
+	fixedNonce string
+	// noMemoryCache skips the in-memory CA cache even if it is enabled, for
+	// downloads that must not be answered with the CA of another download.
+	noMemoryCache bool
+}
+
+// EndpointKind tells how an endpoint was contacted.
+type EndpointKind string
+
+const (
+	// EndpointProbe is a cacerts URL that is already trusted by the system roots.
+	EndpointProbe EndpointKind = "probe"
+	// EndpointHMAC is a cacerts URL verified through the X-Cattle-Hash handshake.
+	EndpointHMAC EndpointKind = "hmac"
+	// EndpointAuthenticated is a resource fetched with the bearer token.
+	EndpointAuthenticated EndpointKind = "authenticated"
+	// EndpointTPM is a resource fetched through TPM attestation.
+	EndpointTPM EndpointKind = "tpm"
+)
+
+// Endpoint is the concrete URL that answered a request.
+type Endpoint struct {
+	URL  string       `json:"url"`
+	Kind EndpointKind `json:"kind"`
+}
+
+// Request describes a single request for OnRequest. Kind is EndpointHMAC when
+// the insecure cacerts download was used.
+type Request struct {
+	URL  string       `json:"url"`
+	Kind EndpointKind `json:"kind"`
+	// StatusCode is 0 if no response was received.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (o *Options) reportRequest(url string, kind EndpointKind, statusCode int, err error) {
+	if o == nil || o.OnRequest == nil {
+		return
+	}
+	request := Request{URL: url, Kind: kind, StatusCode: statusCode}
+	if err != nil {
+		request.Error = err.Error()
+	}
+	o.OnRequest(request)
+}
+
+func (o *Options) reportEndpoint(url string, kind EndpointKind) {
+	if o != nil && o.OnEndpoint != nil {
+		o.OnEndpoint(Endpoint{URL: url, Kind: kind})
+	}
+}
+
+func (o *Options) reportResponseHeader(header http.Header) {
+	if o != nil && o.OnResponseHeader != nil {
+		o.OnResponseHeader(header.Clone())
+	}
 }
 
-func Get(server, token, path string) ([]byte, string, error) {
-	return get(server, token, path, true)
+func Get(ctx context.Context, server, token, path string, opts *Options) ([]byte, string, error) {
+	return Do(ctx, server, token, http.MethodGet, path, nil, true, opts)
 }
 
-func MachineGet(server, token, path string) ([]byte, string, error) {
-	return get(server, token, path, false)
+func MachineGet(ctx context.Context, server, token, path string, opts *Options) ([]byte, string, error) {
+	return Do(ctx, server, token, http.MethodGet, path, nil, false, opts)
 }
 
-func get(server, token, path string, clusterToken bool) ([]byte, string, error) {
-	u, err := url2.Parse(server)
+// Do sends an authenticated request with the given method and body to path on
+// server, trusting the CA downloaded with token, and returns the response body
+// and the CA checksum. Get and MachineGet are Do with GET. A tpm:// token only
+// supports GET since the TPM attestation is a websocket exchange.
+func Do(ctx context.Context, server, token, method, path string, body []byte, clusterToken bool, opts *Options) ([]byte, string, error) {
+	u, err := parseServer(server)
 	if err != nil {
 		return nil, "", err
 	}
 	u.Path = path
 
+	// The token may live in a file to keep it out of process arguments, it is
+	// read before a tpm:// token inside it is resolved
+	token, err = resolveFileToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+
 	var (
 		isTPM bool
 	)
 	if !clusterToken {
-		isTPM, token, err = tpm.ResolveToken(token)
+		isTPM, token, err = resolveToken(ctx, token, opts)
 		if err != nil {
 			return nil, "", err
 		}
 	}
+	token, err = normalizeToken(token)
+	if err != nil {
+		return nil, "", err
+	}
 
-	cacert, caChecksum, err := CACerts(server, token, clusterToken)
+	cacert, caChecksum, err := CACerts(ctx, server, token, clusterToken, opts)
 	if err != nil {
 		return nil, "", err
 	}
+	if err := checkBundleLimits(cacert, opts); err != nil {
+		return nil, "", err
+	}
+	if opts != nil && opts.ExpectedCAChecksum != "" {
+		if err := verifyCAChecksum(cacert, opts.ExpectedCAChecksum); err != nil {
+			return nil, "", err
+		}
+	}
 
 	if isTPM {
-		data, err := tpm.Get(cacert, u.String(), nil)
-		return data, caChecksum, err
+		if method != http.MethodGet {
+			return nil, "", fmt.Errorf("%s is not supported with a tpm:// token, only GET", method)
+		}
+		tpmCtx, cancel := context.WithTimeout(ctx, opts.tpmTimeout())
+		data, err := tpm.Get(tpmCtx, cacert, u.String(), opts.header())
+		cancel()
+		opts.reportRequest(u.String(), EndpointTPM, 0, err)
+		if err != nil {
+			opts.incFailure(err)
+			return nil, "", err
+		}
+		opts.reportEndpoint(u.String(), EndpointTPM)
+		return data, caChecksum, nil
 	}
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	client, err := newAuthenticatedClient(cacert, opts)
 	if err != nil {
 		return nil, "", err
 	}
-	if !clusterToken {
-		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(token)))
-	}
+	defer client.CloseIdleConnections()
 
-	var resp *http.Response
-	if len(cacert) == 0 {
-		resp, err = http.DefaultClient.Do(req)
+	for attempt := 0; ; attempt++ {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
 		if err != nil {
 			return nil, "", err
 		}
-	} else {
-		pool := x509.NewCertPool()
-		pool.AppendCertsFromPEM(cacert)
-		client := http.Client{
-			Timeout: 5 * time.Second,
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				TLSClientConfig: &tls.Config{
-					RootCAs: pool,
-				},
-			},
-		}
-		defer client.CloseIdleConnections()
-
-		resp, err = client.Do(req)
+		opts.setHeaders(req)
+		if !clusterToken {
+			req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(token)))
+		}
+
+		if err := waitRateLimit(ctx); err != nil {
+			return nil, "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			err = &TransportError{URL: u.String(), Err: describeHostnameError(err)}
+			opts.reportRequest(u.String(), EndpointAuthenticated, 0, err)
+			opts.incFailure(err)
+			return nil, "", err
+		}
+
+		// The body is always drained and closed before looking at the status so
+		// the connection is released on every path, including retries
+		data, err := readBody(resp, maxResponseSize)
+		resp.Body.Close()
+		opts.debugBody(resp, data)
+		opts.reportRequest(u.String(), EndpointAuthenticated, resp.StatusCode, err)
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < opts.rateLimitRetries() {
+			delay := rateLimitDelay(resp, attempt)
+			logrus.Infof("Rate limited by %s, retrying in %s", u.String(), delay)
+			opts.incRetry()
+			if err := sleep(ctx, delay); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+			err = &HTTPError{URL: u.String(), StatusCode: resp.StatusCode, Status: resp.Status, Body: data}
+		}
 		if err != nil {
+			opts.incFailure(err)
 			return nil, "", err
 		}
+		opts.reportEndpoint(u.String(), EndpointAuthenticated)
+		return data, caChecksum, nil
 	}
+}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("%s: %s", data, resp.Status)
+func (o *Options) caCertsPath(clusterToken bool) string {
+	switch {
+	case clusterToken && o != nil && o.CACertsPath != "":
+		return o.CACertsPath
+	case clusterToken:
+		return DefaultCACertsPath
+	case o != nil && o.MachineCACertsPath != "":
+		return o.MachineCACertsPath
 	}
-	return data, caChecksum, err
+	return DefaultMachineCACertsPath
 }
 
-func CACerts(server, token string, clusterToken bool) ([]byte, string, error) {
-	nonce, err := randomtoken.Generate()
+func (o *Options) tpmTimeout() time.Duration {
+	if o == nil || o.TPMTimeout <= 0 {
+		return DefaultTPMTimeout
+	}
+	return o.TPMTimeout
+}
+
+// resolveToken resolves a machine token. ForceBearer takes precedence over
+// the TokenResolver of opts, which takes precedence over the TPM. A true
+// isSpecial means the request must go through TPM attestation.
+func resolveToken(ctx context.Context, token string, opts *Options) (bool, string, error) {
+	if opts != nil && opts.ForceBearer {
+		bearer := strings.TrimPrefix(token, "tpm://")
+		if bearer == "" {
+			return false, "", fmt.Errorf("ForceBearer is set but the tpm:// token has no bearer token")
+		}
+		logrus.Warnf("Sending the machine token as a bearer token without TPM attestation")
+		return false, bearer, nil
+	}
+
+	isSpecial, resolved, err := opts.tokenResolver(ctx).Resolve(token)
 	if err != nil {
-		return nil, "", err
+		return false, "", fmt.Errorf("resolving machine token: %w", err)
 	}
+	return isSpecial, resolved, nil
+}
+
+func (o *Options) nonce() (string, error) {
+	if o == nil || o.NonceSource == nil {
+		return randomtoken.Generate()
+	}
+	nonce, err := o.NonceSource()
+	if err == nil && nonce == "" {
+		return "", fmt.Errorf("nonce source returned an empty nonce")
+	}
+	return nonce, err
+}
+
+// verifyCAChecksum checks the checksum of the bytes of cacert themselves rather
+// than the checksum reported along with them, so a stale cache can't pass.
+func verifyCAChecksum(cacert []byte, expected string) error {
+	if len(cacert) == 0 {
+		return fmt.Errorf("expected CA with checksum %s but the server is trusted without one", expected)
+	}
+	if actual := hashHex(cacert); actual != strings.ToLower(expected) {
+		return fmt.Errorf("CA checksum %s does not match the expected %s", actual, expected)
+	}
+	return nil
+}
+
+// errAlreadyTrusted is returned by caCerts when the system roots already trust
+// the server, so no CA was downloaded.
+var errAlreadyTrusted = errors.New("server is already trusted")
 
-	url, err := url2.Parse(server)
+// Result is the outcome of a CA download.
+type Result struct {
+	// CACert is empty if the server needs no extra CA.
+	CACert   []byte
+	Checksum string
+	// AlreadyTrusted is set when the system roots trust the server so no CA
+	// was downloaded, as opposed to a server that verifiably serves no CA.
+	AlreadyTrusted bool
+}
+
+func CACerts(ctx context.Context, server, token string, clusterToken bool, opts *Options) ([]byte, string, error) {
+	result, err := CACertsResult(ctx, server, token, clusterToken, opts)
 	if err != nil {
 		return nil, "", err
 	}
+	return result.CACert, result.Checksum, nil
+}
 
-	requestURL := fmt.Sprintf("https://%s/cacerts", url.Host)
-	if !clusterToken {
-		requestURL = fmt.Sprintf("https://%s/v1-rancheros/cacerts", url.Host)
+// CACertsResult is CACerts telling whether an empty CA means the server is
+// already trusted.
+func CACertsResult(ctx context.Context, server, token string, clusterToken bool, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
 
-	if resp, err := http.Get(requestURL); err == nil {
-		_, _ = ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
+	defer opts.observeDuration(time.Now())
+	result, err := caCertsResult(ctx, server, token, clusterToken, opts)
+	opts.incFailure(err)
+	return result, err
+}
+
+func caCertsResult(ctx context.Context, server, token string, clusterToken bool, opts *Options) (*Result, error) {
+
+	cacert, caChecksum, err := caCertsWithRetry(ctx, server, token, clusterToken, opts)
+	trusted := errors.Is(err, errAlreadyTrusted)
+	if err != nil && !trusted {
+		return nil, err
+	}
+	downloaded, downloadedChecksum := cacert, caChecksum
+
+	if !clusterToken && opts.IncludeClusterCA {
+		cacert, caChecksum, err = mergeClusterCACerts(ctx, server, token, cacert, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CAFingerprint != "" {
+		if err := VerifyCACerts(cacert, opts.CAFingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cacert) > 0 {
+		if err := checkExpiry(cacert, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CheckRevocation && len(cacert) > 0 {
+		if err := checkRevocation(ctx, cacert, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.VerifyAgainstServer && len(cacert) > 0 {
+		if err := verifyAgainstServer(ctx, server, cacert, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only a CA that passed every check is cached for later calls, and never
+	// one of a fixed nonce download which is for testing and validation only
+	if len(downloaded) > 0 && opts.fixedNonce == "" {
+		storeCache(server, clusterToken, downloaded, downloadedChecksum, opts)
+	}
+
+	if opts.CanonicalBundle && len(cacert) > 0 {
+		cacert, err = CanonicalBundle(cacert)
+		if err != nil {
+			return nil, fmt.Errorf("canonicalizing cacerts from %s: %w", server, err)
+		}
+		caChecksum = hashHex(cacert)
+	}
+
+	return &Result{
+		CACert:         cacert,
+		Checksum:       caChecksum,
+		AlreadyTrusted: trusted && len(cacert) == 0,
+	}, nil
+}
+
+// CACertsWithNonce is CACerts with a caller supplied X-Cattle-Nonce, and
+// without the trust probes, so the handshake is always performed. It exists
+// to check that a server rejects replayed nonces and to reproduce hashes
+// from known inputs. It is unsafe for anything else: reusing a nonce lets a
+// recorded response be replayed.
+func CACertsWithNonce(ctx context.Context, server, token, nonce string, clusterToken bool, opts *Options) ([]byte, string, error) {
+	if nonce == "" {
+		return nil, "", fmt.Errorf("nonce must not be empty")
+	}
+
+	var withNonce Options
+	if opts != nil {
+		withNonce = *opts
+	}
+	withNonce.fixedNonce = nonce
+	return CACerts(ctx, server, token, clusterToken, &withNonce)
+}
+
+func mergeClusterCACerts(ctx context.Context, server, token string, cacert []byte, opts *Options) ([]byte, string, error) {
+	// The cluster CA is always downloaded, a cached CA the server happens to
+	// verify against may be the machine CA just fetched
+	cluster := *opts
+	cluster.noMemoryCache = true
+	clusterCACert, _, err := caCertsWithRetry(ctx, server, token, true, &cluster)
+	if err != nil && !errors.Is(err, errAlreadyTrusted) {
+		return nil, "", fmt.Errorf("downloading cluster cacerts: %w", err)
+	}
+
+	cacert = mergeCACerts(cacert, clusterCACert)
+	if len(cacert) == 0 {
 		return nil, "", nil
 	}
+	return cacert, hashHex(cacert), nil
+}
+
+// mergeCACerts concatenates the machine and cluster CA bundles, returning the
+// machine bundle untouched if the cluster bundle is empty or identical to it.
+func mergeCACerts(machine, cluster []byte) []byte {
+	switch {
+	case len(bytes.TrimSpace(cluster)) == 0 || bytes.Equal(bytes.TrimSpace(machine), bytes.TrimSpace(cluster)):
+		return machine
+	case len(bytes.TrimSpace(machine)) == 0:
+		return cluster
+	}
+
+	result := make([]byte, 0, len(machine)+len(cluster)+1)
+	result = append(result, machine...)
+	if !bytes.HasSuffix(result, []byte("\n")) {
+		result = append(result, '\n')
+	}
+	return append(result, cluster...)
+}
+
+func caCerts(ctx context.Context, server, token string, clusterToken bool, opts *Options) ([]byte, string, error) {
+	token, err := normalizeToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkTokenStrength(token, opts); err != nil {
+		return nil, "", err
+	}
 
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	requestURL, err := cacertsURL(server, clusterToken, opts)
 	if err != nil {
 		return nil, "", err
 	}
+
+	// A fixed nonce is only used to test the handshake itself, so don't let the
+	// trust probes short-circuit it
+	var (
+		timings Timings
+		start   = time.Now()
+	)
+
+	nonce := opts.fixedNonce
+	if nonce == "" {
+		if opts.CacheFile != "" {
+			if cacert, checksum, ok := readCacheFile(opts.CacheFile, requestURL, opts); ok {
+				return cacert, checksum, nil
+			}
+		}
+
+		// With a pinned fingerprint the CA must be downloaded even if the system
+		// roots already trust the server
+		if opts.CAFingerprint == "" {
+			probeClient := newClient(nil, opts)
+			defer probeClient.CloseIdleConnections()
+
+			resp, err := probe(ctx, probeClient, requestURL, opts)
+			if err == nil {
+				opts.reportRequest(requestURL, EndpointProbe, resp.StatusCode, nil)
+				_, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				opts.reportEndpoint(requestURL, EndpointProbe)
+				opts.reportResponseHeader(resp.Header)
+				opts.reportTimings(Timings{Probe: time.Since(start)})
+				return nil, "", errAlreadyTrusted
+			}
+			opts.reportRequest(requestURL, EndpointProbe, 0, err)
+			// Only an untrusted certificate calls for the insecure download,
+			// a server that can't be reached at all is reported as such
+			if !isVerificationError(err) {
+				return nil, "", fmt.Errorf("probing cacerts: %w", &TransportError{URL: requestURL, Err: err})
+			}
+			logrus.Debugf("Server %s is not trusted by the system roots: %v", requestURL, err)
+		}
+
+		// A pinned fingerprint is checked against a fresh download only
+		if opts.CAFingerprint == "" && useMemoryCache(requestURL, opts) {
+			if cacert, checksum, ok := probeCachedCA(ctx, requestURL, opts); ok {
+				opts.reportEndpoint(requestURL, EndpointProbe)
+				opts.reportTimings(Timings{Probe: time.Since(start)})
+				return cacert, checksum, nil
+			}
+		}
+		timings.Probe = time.Since(start)
+
+		nonce, err = opts.nonce()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.setHeaders(req)
 	req.Header.Set("X-Cattle-Nonce", nonce)
 	req.Header.Set("Authorization", "Bearer "+hashBase64([]byte(token)))
 
-	resp, err := insecureClient.Do(req)
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, "", err
+	}
+	start = time.Now()
+	client := newInsecureClient(opts)
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("insecure cacerts download from %s: %w", requestURL, err)
+		err = fmt.Errorf("insecure cacerts download: %w", &TransportError{URL: requestURL, Err: err})
+		opts.reportRequest(requestURL, EndpointHMAC, 0, err)
+		return nil, "", err
 	}
 	defer resp.Body.Close()
+	timings.Handshake = time.Since(start)
 
-	data, err := ioutil.ReadAll(resp.Body)
+	data, checksum, err := verifyCACertsResponse(resp, requestURL, token, nonce, &timings, opts)
+	opts.reportRequest(requestURL, EndpointHMAC, resp.StatusCode, err)
 	if err != nil {
 		return nil, "", err
 	}
+	opts.reportEndpoint(requestURL, EndpointHMAC)
+	opts.reportResponseHeader(resp.Header)
+	opts.reportTimings(timings)
+	if len(data) == 0 {
+		return nil, "", nil
+	}
+	return data, checksum, nil
+}
+
+// verifyCACertsResponse reads the CA of a cacerts response and checks its
+// X-Cattle-Hash.
+func verifyCACertsResponse(resp *http.Response, requestURL, token, nonce string, timings *Timings, opts *Options) ([]byte, string, error) {
+	start := time.Now()
+	data, err := readBody(resp, opts.maxBundleSize())
+	if err != nil {
+		return nil, "", err
+	}
+	timings.Download = time.Since(start)
+	opts.debugBody(resp, data)
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("response %d: %s getting cacerts: %s", resp.StatusCode, resp.Status, data)
+		return nil, "", &HTTPError{URL: requestURL, StatusCode: resp.StatusCode, Status: resp.Status, Body: data}
 	}
 
-	if resp.Header.Get("X-Cattle-Hash") != hash(token, nonce, data) {
-		return nil, "", fmt.Errorf("response hash (%s) does not match (%s)",
-			resp.Header.Get("X-Cattle-Hash"),
-			hash(token, nonce, data))
+	start = time.Now()
+	digest, err := responseDigest(opts, resp.Header.Get("X-Cattle-Hash-Algorithm"))
+	if err != nil {
+		return nil, "", fmt.Errorf("verifying cacerts from %s: %w", requestURL, err)
+	}
+	if err := verifyHash(digest, token, nonce, data, resp.Header.Get("X-Cattle-Hash")); err != nil {
+		return nil, "", fmt.Errorf("verifying cacerts from %s: %w", requestURL, err)
 	}
+	timings.Verify = time.Since(start)
 
 	if len(data) == 0 {
 		return nil, "", nil
 	}
-
 	return data, hashHex(data), nil
 }
 
@@ -171,12 +763,43 @@ func hashBase64(token []byte) string {
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
-func hash(token, nonce string, bytes []byte) string {
-	digest := hmac.New(sha512.New, []byte(token))
+// ExpectedHash returns the X-Cattle-Hash a Rancher server must send with body
+// in answer to nonce for token, the base64 HMAC-SHA512 keyed with the token
+// of the nonce and the body, each followed by a NUL byte. It reproduces the
+// check of CACerts from a captured response when debugging a hash mismatch.
+func ExpectedHash(token, nonce string, body []byte) string {
+	return ExpectedHashDigest(DefaultDigest, token, nonce, body)
+}
+
+// ExpectedHashDigest is ExpectedHash for a server using another digest, see
+// X-Cattle-Hash-Algorithm.
+func ExpectedHashDigest(d Digest, token, nonce string, body []byte) string {
+	return base64.StdEncoding.EncodeToString(hashHMAC(d, token, nonce, body))
+}
+
+func hashHMAC(d Digest, token, nonce string, bytes []byte) []byte {
+	digest := hmac.New(d.New, []byte(token))
 	digest.Write([]byte(nonce))
 	digest.Write([]byte{0})
 	digest.Write(bytes)
 	digest.Write([]byte{0})
-	hash := digest.Sum(nil)
-	return base64.StdEncoding.EncodeToString(hash)
+	return digest.Sum(nil)
+}
+
+// verifyHash checks the X-Cattle-Hash header against the HMAC of data in
+// constant time. A missing header means the server does not know the token or
+// does not speak the handshake at all, a wrong one that the token or the
+// response is not what the server sent.
+func verifyHash(d Digest, token, nonce string, data []byte, header string) error {
+	if header == "" {
+		return fmt.Errorf("%w, the server does not know the token or is not a Rancher server", ErrHashMissing)
+	}
+
+	expected := hashHMAC(d, token, nonce, data)
+	actual, err := base64.StdEncoding.DecodeString(header)
+	if err != nil || !hmac.Equal(actual, expected) {
+		return fmt.Errorf("%w: got %s, expected %s, the token is wrong or the response was tampered with",
+			ErrHashMismatch, header, base64.StdEncoding.EncodeToString(expected))
+	}
+	return nil
 }
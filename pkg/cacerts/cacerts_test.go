@@ -0,0 +1,303 @@
+package cacerts
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testToken = "kh2x4b7q9rl6w8mfz5tvn3cjdsp2gy4kt9xw7qbl5rm8hzcnv6jd"
+
+// newUnstartedCACertsServer returns a TLS server answering the cacerts
+// handshake for token with cacert, or with its own certificate if cacert is
+// nil, and passing every other request to handler.
+func newUnstartedCACertsServer(t *testing.T, token string, cacert []byte, handler http.Handler) *httptest.Server {
+	t.Helper()
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != DefaultCACertsPath && r.URL.Path != DefaultMachineCACertsPath {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body := cacert
+		if body == nil {
+			body = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		}
+		if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+			w.Header().Set("X-Cattle-Hash", ExpectedHash(token, nonce, body))
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newCACertsServer is newUnstartedCACertsServer, started.
+func newCACertsServer(t *testing.T, token string, cacert []byte, handler http.Handler) *httptest.Server {
+	t.Helper()
+	srv := newUnstartedCACertsServer(t, token, cacert, handler)
+	srv.StartTLS()
+	return srv
+}
+
+// testOptions doesn't retry, so failures show up right away.
+func testOptions() *Options {
+	return &Options{
+		Retry: &RetryPolicy{Attempts: 1},
+	}
+}
+
+func TestDoReusesConnectionsAndClosesBodies(t *testing.T) {
+	var (
+		lock        sync.Mutex
+		open        int
+		remoteAddrs []string
+	)
+	srv := newUnstartedCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		remoteAddrs = append(remoteAddrs, r.RemoteAddr)
+		attempt := len(remoteAddrs)
+		lock.Unlock()
+
+		switch {
+		case r.URL.Path == "/v3/fail":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		case attempt == 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	srv.StartTLS()
+
+	// Every connection must be closed once Do returns, the server only notices
+	// a moment later
+	waitClosed := func() {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			lock.Lock()
+			n := open
+			lock.Unlock()
+			if n == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d connections still open", n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx := context.Background()
+	data, _, err := Get(ctx, srv.URL, testToken, "/v3/settings", testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ok" {
+		t.Fatalf("Get() = %q, want ok", data)
+	}
+	lock.Lock()
+	reused := len(remoteAddrs) == 2 && remoteAddrs[0] == remoteAddrs[1]
+	lock.Unlock()
+	if !reused {
+		t.Fatalf("the retry after a 429 should reuse the connection, requests came from %v", remoteAddrs)
+	}
+	waitClosed()
+
+	_, _, err = Get(ctx, srv.URL, testToken, "/v3/fail", testOptions())
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Get() error = %v, want a 500 HTTPError", err)
+	}
+	waitClosed()
+}
+
+func TestNonceSource(t *testing.T) {
+	const nonce = "0123456789abcdef"
+	ca := newTestCA(t, "rancher CA")
+
+	// The hash is computed here rather than with ExpectedHash, so the test
+	// also pins down the framing of the handshake
+	mac := hmac.New(sha512.New, []byte(testToken))
+	mac.Write([]byte(nonce + "\x00"))
+	mac.Write(ca.pem)
+	mac.Write([]byte("\x00"))
+	hash := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	var (
+		lock   sync.Mutex
+		nonces []string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Cattle-Nonce") == "" {
+			return
+		}
+		lock.Lock()
+		nonces = append(nonces, r.Header.Get("X-Cattle-Nonce"))
+		lock.Unlock()
+		w.Header().Set("X-Cattle-Hash", hash)
+		_, _ = w.Write(ca.pem)
+	}))
+	t.Cleanup(srv.Close)
+
+	opts := testOptions()
+	opts.NonceSource = func() (string, error) {
+		return nonce, nil
+	}
+	cacert, checksum, err := CACerts(context.Background(), srv.URL, testToken, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cacert) != string(ca.pem) || checksum != hashHex(ca.pem) {
+		t.Errorf("CACerts() = %q, %s, want the served CA", cacert, checksum)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(nonces) != 1 || nonces[0] != nonce {
+		t.Errorf("server received nonces %v, want %s", nonces, nonce)
+	}
+
+	for name, source := range map[string]func() (string, error){
+		"empty": func() (string, error) {
+			return "", nil
+		},
+		"error": func() (string, error) {
+			return "", errors.New("no entropy")
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := testOptions()
+			opts.NonceSource = source
+			if _, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts); err == nil {
+				t.Error("CACerts() succeeded without a nonce")
+			}
+		})
+	}
+}
+
+// newHandshakeCountingServer returns a TLS server serving its own certificate
+// as the CA and counting the X-Cattle-Hash handshakes in handshakes.
+func newHandshakeCountingServer(t *testing.T, handshakes *int32) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+			atomic.AddInt32(handshakes, 1)
+			w.Header().Set("X-Cattle-Hash", ExpectedHash(testToken, nonce, body))
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	// Every httptest server has the same certificate, so don't leave its CA
+	// behind for a later server on the same port
+	t.Cleanup(func() {
+		requestURL, err := cacertsURL(srv.URL, true, nil)
+		if err != nil {
+			return
+		}
+		caCacheLock.Lock()
+		defer caCacheLock.Unlock()
+		delete(caCache, requestURL)
+	})
+	return srv
+}
+
+func TestMemoryCache(t *testing.T) {
+	tests := []struct {
+		name           string
+		memoryCache    bool
+		seed           bool
+		wantHandshakes int32
+	}{
+		{
+			name:           "disabled by default",
+			wantHandshakes: 2,
+		},
+		{
+			name:           "MemoryCache",
+			memoryCache:    true,
+			wantHandshakes: 1,
+		},
+		{
+			name:           "LoadCacheFromFile",
+			seed:           true,
+			wantHandshakes: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handshakes int32
+			srv := newHandshakeCountingServer(t, &handshakes)
+			cacert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+			if tt.seed {
+				anchor := filepath.Join(t.TempDir(), "additional-ca.pem")
+				if err := ioutil.WriteFile(anchor, cacert, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := LoadCacheFromFile(anchor, srv.URL); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				opts := testOptions()
+				opts.MemoryCache = tt.memoryCache
+				got, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(cacert) {
+					t.Errorf("CACerts() = %q, want the served CA", got)
+				}
+			}
+			if got := atomic.LoadInt32(&handshakes); got != tt.wantHandshakes {
+				t.Errorf("%d handshakes for two calls, want %d", got, tt.wantHandshakes)
+			}
+		})
+	}
+}
+
+func TestCacheFileBundleLimits(t *testing.T) {
+	bundle := append(append([]byte{}, newTestCA(t, "rancher CA").pem...), newTestCA(t, "next rancher CA").pem...)
+	srv := newCACertsServer(t, testToken, bundle, nil)
+
+	opts := testOptions()
+	opts.MaxBundleCerts = 1
+	opts.CacheFile = filepath.Join(t.TempDir(), "cacerts.pem")
+	if _, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(opts.CacheFile); err == nil {
+		t.Error("a bundle over MaxBundleCerts was written to the CacheFile")
+	}
+}
@@ -0,0 +1,195 @@
+package cacerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type cachedCA struct {
+	cacert   []byte
+	checksum string
+	// seeded is set for a CA loaded by LoadCacheFromFile, which enables the
+	// cache for its URL without Options.MemoryCache
+	seeded bool
+}
+
+var (
+	caCacheLock sync.Mutex
+	// caCache holds the last verified CA of each cacerts URL, so the CA of one
+	// server or path is never offered for another
+	caCache = map[string]cachedCA{}
+
+	// cacheFileLock serializes access to the CacheFile of all callers in this
+	// process.
+	cacheFileLock sync.Mutex
+)
+
+// LoadCacheFromFile seeds the in-memory CA cache of the cluster cacerts URL of
+// server from a trust anchor written by a previous run, typically the
+// additional-ca.pem, so the first request after a restart can verify the
+// server without the insecure handshake. This enables the cache for that URL
+// even without Options.MemoryCache. The default CACertsPath is assumed.
+func LoadCacheFromFile(path, server string) error {
+	requestURL, err := cacertsURL(server, true, nil)
+	if err != nil {
+		return err
+	}
+
+	cacert, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(cacert)) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+	if err := checkBundleLimits(cacert, nil); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(cacert) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+
+	storeCachedCA(requestURL, cacert, hashHex(cacert), true)
+	return nil
+}
+
+// storeCachedCA replaces the CA cached for requestURL, which stays seeded once
+// it was loaded by LoadCacheFromFile.
+func storeCachedCA(requestURL string, cacert []byte, checksum string, seeded bool) {
+	caCacheLock.Lock()
+	defer caCacheLock.Unlock()
+	caCache[requestURL] = cachedCA{
+		cacert:   cacert,
+		checksum: checksum,
+		seeded:   seeded || caCache[requestURL].seeded,
+	}
+}
+
+func getCachedCA(requestURL string) cachedCA {
+	caCacheLock.Lock()
+	defer caCacheLock.Unlock()
+	return caCache[requestURL]
+}
+
+// useMemoryCache tells whether the in-memory cache is read and filled for
+// requestURL, which is only the case once the caller opted in through
+// Options.MemoryCache or LoadCacheFromFile.
+func useMemoryCache(requestURL string, opts *Options) bool {
+	if opts.noMemoryCache {
+		return false
+	}
+	return opts.MemoryCache || getCachedCA(requestURL).seeded
+}
+
+// storeCache stores a verified CA of server in the in-memory cache, if it is
+// enabled, and the CacheFile of opts.
+func storeCache(server string, clusterToken bool, cacert []byte, checksum string, opts *Options) {
+	requestURL, err := cacertsURL(server, clusterToken, opts)
+	if err != nil {
+		return
+	}
+	if useMemoryCache(requestURL, opts) {
+		storeCachedCA(requestURL, cacert, checksum, false)
+	}
+	if opts.CacheFile != "" {
+		if err := checkBundleLimits(cacert, opts); err != nil {
+			logrus.Warnf("Not writing cacerts cache %s: %v", opts.CacheFile, err)
+			return
+		}
+		if err := writeCacheFile(opts.CacheFile, requestURL, cacert, checksum); err != nil {
+			logrus.Warnf("Failed to write cacerts cache %s: %v", opts.CacheFile, err)
+		}
+	}
+}
+
+// probeCachedCA returns the CA cached for requestURL if it presents a
+// certificate that verifies against it.
+func probeCachedCA(ctx context.Context, requestURL string, opts *Options) ([]byte, string, bool) {
+	cached := getCachedCA(requestURL)
+	if len(cached.cacert) == 0 {
+		return nil, "", false
+	}
+
+	client := newClient(cached.cacert, opts)
+	defer client.CloseIdleConnections()
+
+	resp, err := probe(ctx, client, requestURL, opts)
+	if err != nil {
+		return nil, "", false
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", false
+	}
+	return cached.cacert, cached.checksum, true
+}
+
+// readCacheFile returns the CA stored in path by writeCacheFile if it was
+// downloaded from requestURL and still matches its checksum. The sidecar
+// path.checksum holds the checksum and the URL, separated by a space.
+func readCacheFile(path, requestURL string, opts *Options) ([]byte, string, bool) {
+	cacheFileLock.Lock()
+	defer cacheFileLock.Unlock()
+
+	sidecar, err := ioutil.ReadFile(path + ".checksum")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("Ignoring cacerts cache %s: %v", path, err)
+		}
+		return nil, "", false
+	}
+	checksum, cachedURL, _ := strings.Cut(strings.TrimSpace(string(sidecar)), " ")
+	if cachedURL != requestURL {
+		logrus.Debugf("Ignoring cacerts cache %s of %s, requesting %s", path, cachedURL, requestURL)
+		return nil, "", false
+	}
+
+	cacert, err := ioutil.ReadFile(path)
+	if err != nil {
+		logrus.Debugf("Ignoring cacerts cache %s: %v", path, err)
+		return nil, "", false
+	}
+	if hashHex(cacert) != checksum {
+		logrus.Debugf("Ignoring cacerts cache %s, checksum does not match", path)
+		return nil, "", false
+	}
+	if err := checkBundleLimits(cacert, opts); err != nil {
+		logrus.Debugf("Ignoring cacerts cache %s: %v", path, err)
+		return nil, "", false
+	}
+	return cacert, checksum, true
+}
+
+// writeCacheFile stores a verified CA in path along with its sidecar, see
+// readCacheFile.
+func writeCacheFile(path, requestURL string, cacert []byte, checksum string) error {
+	cacheFileLock.Lock()
+	defer cacheFileLock.Unlock()
+
+	// Skip rewriting and syncing a cache that already holds this CA
+	sidecar := []byte(checksum + " " + requestURL + "\n")
+	if current, err := ioutil.ReadFile(path + ".checksum"); err == nil && bytes.Equal(current, sidecar) {
+		if cached, err := ioutil.ReadFile(path); err == nil && bytes.Equal(cached, cacert) {
+			return nil
+		}
+	}
+
+	// Drop the sidecar first so a crash in between never pairs it with another CA
+	if err := os.Remove(path + ".checksum"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := WriteCAFile(path, cacert); err != nil {
+		return err
+	}
+	return WriteCAFile(path+".checksum", sidecar)
+}
@@ -0,0 +1,317 @@
+package cacerts
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the timeout of each HTTP request.
+	DefaultTimeout = 5 * time.Second
+	// DefaultTPMTimeout bounds every exchange with the TPM.
+	DefaultTPMTimeout = 30 * time.Second
+)
+
+// newClient returns a client trusting cacert on top of the system roots, or
+// only cacert if PinnedCAOnly is set.
+func newClient(cacert []byte, opts *Options) *http.Client {
+	return newClientWithCertificates(cacert, opts, nil)
+}
+
+// newAuthenticatedClient is newClient presenting the client certificate of
+// opts, if any.
+func newAuthenticatedClient(cacert []byte, opts *Options) (*http.Client, error) {
+	certs, err := opts.clientCertificates()
+	if err != nil {
+		return nil, err
+	}
+	return newClientWithCertificates(cacert, opts, certs), nil
+}
+
+func (o *Options) clientCertificates() ([]tls.Certificate, error) {
+	switch {
+	case o == nil:
+		return nil, nil
+	case o.ClientCertificate != nil:
+		return []tls.Certificate{*o.ClientCertificate}, nil
+	case o.ClientCertFile != "" || o.ClientKeyFile != "":
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		return []tls.Certificate{cert}, nil
+	}
+	return nil, nil
+}
+
+func newClientWithCertificates(cacert []byte, opts *Options, certs []tls.Certificate) *http.Client {
+	tlsConfig := opts.tlsConfig()
+	tlsConfig.Certificates = certs
+	if opts != nil {
+		tlsConfig.ServerName = opts.ServerName
+	}
+	if len(cacert) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || (opts != nil && opts.PinnedCAOnly) {
+			pool = x509.NewCertPool()
+		}
+		pool.AppendCertsFromPEM(cacert)
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:       opts.timeout(),
+		Transport:     newTransport(tlsConfig, opts),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// newInsecureClient returns a client that doesn't verify certificates, only
+// to be used for the cacerts download which is verified by its X-Cattle-Hash.
+// The TLS version and cipher suites are still restricted as for newClient.
+func newInsecureClient(opts *Options) *http.Client {
+	tlsConfig := opts.tlsConfig()
+	tlsConfig.InsecureSkipVerify = true
+
+	return &http.Client{
+		Timeout:       opts.timeout(),
+		Transport:     newTransport(tlsConfig, opts),
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// maxRedirects is the same limit as the default policy of http.Client.
+const maxRedirects = 10
+
+// checkRedirect only follows redirects to the same scheme and host. Go drops
+// the Authorization header on a redirect to another host, which would show up
+// as a confusing 401, and sending the token there isn't wanted either, so such
+// a redirect fails with an error naming both URLs instead.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	previous := via[len(via)-1].URL
+	if req.URL.Scheme != previous.Scheme || req.URL.Host != previous.Host {
+		return fmt.Errorf("refusing redirect from %s to %s, point the server URL at the final host instead", previous, req.URL)
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS settings shared by every client.
+func (o *Options) tlsConfig() *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if o != nil {
+		if o.MinTLSVersion != 0 {
+			tlsConfig.MinVersion = o.MinTLSVersion
+		}
+		tlsConfig.CipherSuites = o.CipherSuites
+	}
+	return tlsConfig
+}
+
+func (o *Options) timeout() time.Duration {
+	if o == nil || o.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return o.Timeout
+}
+
+// newTransport returns a transport resolving hosts with the Resolver of opts
+// and going through its Proxy, or the proxy from the environment.
+// When a proxy is in use only the proxy host is resolved locally, the target
+// host is resolved by the proxy. The Transport of opts takes precedence, only
+// DisableHTTP2 is applied to it.
+func newTransport(tlsConfig *tls.Config, opts *Options) http.RoundTripper {
+	if opts != nil && opts.Transport != nil {
+		transport := opts.Transport
+		if custom, ok := transport.(*http.Transport); ok && opts.DisableHTTP2 {
+			custom = custom.Clone()
+			disableHTTP2(custom)
+			transport = custom
+		}
+		return opts.debugTransport(transport)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	proxy := http.ProxyFromEnvironment
+	if opts != nil {
+		dialer.Resolver = opts.Resolver
+		if opts.Proxy != nil {
+			proxy = opts.Proxy
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:           proxy,
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: tlsConfig,
+	}
+	if opts != nil && opts.DisableHTTP2 {
+		disableHTTP2(transport)
+	}
+	return opts.debugTransport(transport)
+}
+
+// disableHTTP2 keeps transport on HTTP/1.1. A non-nil empty TLSNextProto is
+// what keeps it from ever upgrading, but a cloned transport may already offer
+// h2 through ALPN, which the server would then speak.
+func disableHTTP2(transport *http.Transport) {
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if transport.TLSClientConfig == nil {
+		return
+	}
+	var nextProtos []string
+	for _, proto := range transport.TLSClientConfig.NextProtos {
+		if proto != "h2" {
+			nextProtos = append(nextProtos, proto)
+		}
+	}
+	transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+	transport.TLSClientConfig.NextProtos = nextProtos
+}
+
+// NewRancherHTTPClient downloads the CA of server using the cluster token and
+// returns a client that trusts it. If the server is already trusted by the
+// system roots the client uses those instead.
+func NewRancherHTTPClient(ctx context.Context, server, token string) (*http.Client, error) {
+	cacert, _, err := CACerts(ctx, server, token, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBundleLimits(cacert, nil); err != nil {
+		return nil, err
+	}
+	return newClient(cacert, nil), nil
+}
+
+// verifyAgainstServer checks that the certificate served by server verifies
+// with cacert as the only root.
+func verifyAgainstServer(ctx context.Context, server string, cacert []byte, opts *Options) error {
+	u, err := parseServer(server)
+	if err != nil {
+		return err
+	}
+
+	pinned := *opts
+	pinned.PinnedCAOnly = true
+	pinned.Transport = nil
+	client := newClient(cacert, &pinned)
+	defer client.CloseIdleConnections()
+
+	resp, err := probe(ctx, client, u.String(), opts)
+	if err != nil {
+		err = describeHostnameError(err)
+		if isVerificationError(err) {
+			return fmt.Errorf("certificate served by %s does not verify against the downloaded CA: %w", u.Host, err)
+		}
+		return &TransportError{URL: u.String(), Err: err}
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return nil
+}
+
+// probe sends a plain GET to url, used to find out if url is trusted by the
+// roots of client.
+func probe(ctx context.Context, client *http.Client, url string, opts *Options) (*http.Response, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts.setHeaders(req)
+	return client.Do(req)
+}
+
+// isVerificationError tells if err is the server certificate failing to
+// verify, rather than the server not being reachable.
+func isVerificationError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalid          x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		systemRoots      x509.SystemRootsError
+	)
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &systemRoots)
+}
+
+// describeHostnameError turns a certificate hostname mismatch into an error
+// listing the names the certificate is actually valid for.
+func describeHostnameError(err error) error {
+	var hostErr x509.HostnameError
+	if !errors.As(err, &hostErr) || hostErr.Certificate == nil {
+		return err
+	}
+
+	var sans []string
+	sans = append(sans, hostErr.Certificate.DNSNames...)
+	for _, ip := range hostErr.Certificate.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return fmt.Errorf("server certificate is valid for [%s] but not for requested host %s, set ServerName if the TLS server name must differ from the dialed host: %w",
+		strings.Join(sans, ", "), hostErr.Host, err)
+}
+
+// maxResponseSize bounds the body of an authenticated request, which unlike a
+// CA bundle has no configurable limit.
+const maxResponseSize = 64 << 20
+
+// readBody reads the body of resp, decoding it if it is still compressed.
+// The transport only does that for gzip and only when it asked for it, which
+// it doesn't if Header or a custom Transport set Accept-Encoding. Reading
+// stops with an error past limit bytes of decoded content, so neither a huge
+// response nor a decompression bomb is read into memory.
+func readBody(resp *http.Response, limit int) ([]byte, error) {
+	var body io.Reader = resp.Body
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decoding gzip response: %w", err)
+		}
+		defer gz.Close()
+		body = gz
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decoding deflate response: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("response exceeds the limit of %d bytes", limit)
+	}
+	return data, nil
+}
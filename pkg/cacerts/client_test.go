@@ -0,0 +1,546 @@
+package cacerts
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testSystemRoot is the only root of the system pool, see TestMain.
+var testSystemRoot *testCert
+
+// TestMain makes testSystemRoot the system roots of the package, standing in
+// for a publicly trusted CA. The system pool is loaded once per process, so
+// it must be set up before any test runs.
+func TestMain(m *testing.M) {
+	os.Exit(func() int {
+		dir, err := ioutil.TempDir("", "cacerts")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+
+		testSystemRoot, err = generateTestCert(&x509.Certificate{
+			Subject: pkix.Name{CommonName: "public root"},
+			IsCA:    true,
+		}, nil)
+		if err != nil {
+			panic(err)
+		}
+		file := filepath.Join(dir, "roots.pem")
+		if err := ioutil.WriteFile(file, testSystemRoot.pem, 0600); err != nil {
+			panic(err)
+		}
+		os.Setenv("SSL_CERT_FILE", file)
+		os.Setenv("SSL_CERT_DIR", dir)
+
+		return m.Run()
+	}())
+}
+
+// newTestServer starts a TLS server for 127.0.0.1 with a certificate signed
+// by issuer.
+func newTestServer(t *testing.T, issuer *testCert, handler http.Handler) *httptest.Server {
+	t.Helper()
+	leaf := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, issuer)
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{leaf.tlsCertificate()},
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// noProxy keeps the proxy environment of the machine running the tests out of
+// the requests.
+func noProxy(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// newTestResolver returns a resolver backed by a DNS server on loopback that
+// answers the A query of name with 127.0.0.1 and knows no other name. The
+// number of queries for name is counted in queries.
+func newTestResolver(t *testing.T, name string, queries *int32) *net.Resolver {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+
+			response := dnsmessage.Message{
+				Header: dnsmessage.Header{
+					ID:            header.ID,
+					Response:      true,
+					Authoritative: true,
+				},
+				Questions: []dnsmessage.Question{question},
+			}
+			switch {
+			case !strings.EqualFold(question.Name.String(), name+"."):
+				response.Header.RCode = dnsmessage.RCodeNameError
+			case question.Type == dnsmessage.TypeA:
+				atomic.AddInt32(queries, 1)
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  question.Name,
+						Type:  dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET,
+						TTL:   60,
+					},
+					Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestResolver(t *testing.T) {
+	srv := newCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate of httptest is valid for example.com
+	const name = "example.com"
+	var queries int32
+	opts := testOptions()
+	opts.Resolver = newTestResolver(t, name, &queries)
+	opts.Proxy = noProxy
+
+	data, _, err := Get(context.Background(), "https://"+net.JoinHostPort(name, port), testToken, "/v3/ping", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pong" {
+		t.Errorf("Get() = %q, want pong", data)
+	}
+	if atomic.LoadInt32(&queries) == 0 {
+		t.Errorf("%s was not resolved through the resolver of Options", name)
+	}
+}
+
+// withCacheFile stores cacert in a CacheFile for the cacerts URL of server
+// and sets it on opts, so the CA is never downloaded.
+func withCacheFile(t *testing.T, server string, cacert []byte, opts *Options) {
+	t.Helper()
+	requestURL, err := cacertsURL(server, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.CacheFile = filepath.Join(t.TempDir(), "cacerts.pem")
+	if err := writeCacheFile(opts.CacheFile, requestURL, cacert, hashHex(cacert)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	clientCA := newTestCA(t, "client CA")
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "node"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, clientCA)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	keyDER, err := x509.MarshalECPrivateKey(client.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, client.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newUnstartedCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA.cert)
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	srv.StartTLS()
+	// The ingress requires the certificate on every path, the insecure
+	// download included, so the CA comes from the cache
+	cacert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	certificate := client.tlsCertificate()
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{
+			name: "certificate",
+			opts: Options{ClientCertificate: &certificate},
+		},
+		{
+			name: "files",
+			opts: Options{ClientCertFile: certFile, ClientKeyFile: keyFile},
+		},
+		{
+			name:    "no certificate",
+			wantErr: true,
+		},
+		{
+			name:    "missing key file",
+			opts:    Options{ClientCertFile: certFile},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Retry = &RetryPolicy{Attempts: 1}
+			withCacheFile(t, srv.URL, cacert, &opts)
+
+			data, _, err := Get(context.Background(), srv.URL, testToken, "/v3/whoami", &opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(data) != "node" {
+				t.Errorf("Get() = %q, want the common name of the client certificate", data)
+			}
+		})
+	}
+}
+
+func TestProxy(t *testing.T) {
+	srv := newCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := net.JoinHostPort("example.com", port)
+
+	// The proxy tunnels every CONNECT to the server, whatever the target, so
+	// the name is never resolved
+	var (
+		lock    sync.Mutex
+		targets []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		lock.Lock()
+		targets = append(targets, r.Host)
+		lock.Unlock()
+
+		upstream, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Proxy = http.ProxyURL(proxyURL)
+	data, _, err := Get(context.Background(), "https://"+target, testToken, "/v3/ping", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "pong" {
+		t.Errorf("Get() = %q, want pong", data)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// The probe, the insecure download and the authenticated fetch
+	if len(targets) < 3 {
+		t.Errorf("only %d requests went through the proxy, want at least 3", len(targets))
+	}
+	for _, got := range targets {
+		if got != target {
+			t.Errorf("CONNECT to %s, want %s", got, target)
+		}
+	}
+}
+
+func TestSystemRootsAndDownloadedCA(t *testing.T) {
+	rancherCA := newTestCA(t, "rancher CA")
+	pong := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	})
+	// A load balancer with a publicly trusted certificate and an ingress
+	// serving the certificate of the downloaded CA
+	public := newTestServer(t, testSystemRoot, pong)
+	private := newTestServer(t, rancherCA, pong)
+
+	tests := []struct {
+		name         string
+		server       string
+		pinnedCAOnly bool
+		wantErr      bool
+	}{
+		{
+			name:   "publicly trusted",
+			server: public.URL,
+		},
+		{
+			name:         "publicly trusted with PinnedCAOnly",
+			server:       public.URL,
+			pinnedCAOnly: true,
+			wantErr:      true,
+		},
+		{
+			name:   "downloaded CA",
+			server: private.URL,
+		},
+		{
+			name:         "downloaded CA with PinnedCAOnly",
+			server:       private.URL,
+			pinnedCAOnly: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.PinnedCAOnly = tt.pinnedCAOnly
+			withCacheFile(t, tt.server, rancherCA.pem, opts)
+
+			data, _, err := Get(context.Background(), tt.server, testToken, "/v3/ping", opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(data) != "pong" {
+				t.Errorf("Get() = %q, want pong", data)
+			}
+		})
+	}
+}
+
+func TestCompressedResponse(t *testing.T) {
+	ca := newTestCA(t, "rancher CA")
+	compressors := map[string]func([]byte) []byte{
+		"gzip": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			_, _ = w.Write(data)
+			w.Close()
+			return buf.Bytes()
+		},
+		"deflate": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := zlib.NewWriter(&buf)
+			_, _ = w.Write(data)
+			w.Close()
+			return buf.Bytes()
+		},
+	}
+
+	for encoding, compress := range compressors {
+		encoding, compress := encoding, compress
+		// The ingress compresses whatever the client asked for, and the
+		// hash covers the decoded CA
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+				w.Header().Set("X-Cattle-Hash", ExpectedHash(testToken, nonce, ca.pem))
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			_, _ = w.Write(compress(ca.pem))
+		}))
+		t.Cleanup(srv.Close)
+
+		for _, acceptEncoding := range []string{"", encoding} {
+			t.Run(encoding+" accepting "+acceptEncoding, func(t *testing.T) {
+				opts := testOptions()
+				if acceptEncoding != "" {
+					// The transport leaves the body compressed when the
+					// header is set by the caller
+					opts.Header = http.Header{"Accept-Encoding": []string{acceptEncoding}}
+				}
+
+				cacert, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(cacert, ca.pem) {
+					t.Errorf("CACerts() = %q, want the decoded CA", cacert)
+				}
+				if _, err := ParseBundle(cacert); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAgainstServer(t *testing.T) {
+	rancherCA := newTestCA(t, "rancher CA")
+	// Both servers answer the handshake with rancherCA, only the first one
+	// serves a certificate signed by it
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+			w.Header().Set("X-Cattle-Hash", ExpectedHash(testToken, nonce, rancherCA.pem))
+		}
+		_, _ = w.Write(rancherCA.pem)
+	})
+	signed := newTestServer(t, rancherCA, handler)
+	other := httptest.NewTLSServer(handler)
+	t.Cleanup(other.Close)
+
+	tests := []struct {
+		name                string
+		server              string
+		verifyAgainstServer bool
+		wantErr             bool
+	}{
+		{
+			name:                "signed by the CA",
+			server:              signed.URL,
+			verifyAgainstServer: true,
+		},
+		{
+			name:                "not signed by the CA",
+			server:              other.URL,
+			verifyAgainstServer: true,
+			wantErr:             true,
+		},
+		{
+			name:   "not signed by the CA without VerifyAgainstServer",
+			server: other.URL,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.VerifyAgainstServer = tt.verifyAgainstServer
+
+			cacert, _, err := CACerts(context.Background(), tt.server, testToken, true, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CACerts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(cacert, rancherCA.pem) {
+				t.Errorf("CACerts() = %q, want the served CA", cacert)
+			}
+		})
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	srv := newUnstartedCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+
+	for _, tt := range []struct {
+		disableHTTP2 bool
+		wantProto    string
+	}{
+		{disableHTTP2: false, wantProto: "HTTP/2.0"},
+		{disableHTTP2: true, wantProto: "HTTP/1.1"},
+	} {
+		t.Run(tt.wantProto, func(t *testing.T) {
+			// A caller supplied transport that negotiates HTTP/2 on its own
+			pool := x509.NewCertPool()
+			pool.AddCert(srv.Certificate())
+			transport := &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool},
+				ForceAttemptHTTP2: true,
+			}
+			defer transport.CloseIdleConnections()
+
+			opts := testOptions()
+			opts.Transport = transport
+			opts.DisableHTTP2 = tt.disableHTTP2
+			data, _, err := Get(context.Background(), srv.URL, testToken, "/v3/proto", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantProto {
+				t.Errorf("request used %s, want %s", data, tt.wantProto)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package cacerts
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	url2 "net/url"
+	"time"
+)
+
+// ConnectivityResult is the outcome of connecting to one endpoint.
+type ConnectivityResult struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Reachable is set once the TCP connection and TLS handshake succeeded.
+	Reachable bool `json:"reachable"`
+	// Latency is the time taken by the TCP connection and TLS handshake.
+	Latency    time.Duration `json:"latency"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// CheckConnectivity connects to the cacerts and ping endpoints of server, and
+// to each of apiServers, without verifying certificates or sending a token.
+// It only tells whether the network path works, not whether it is trusted.
+func CheckConnectivity(ctx context.Context, server string, apiServers ...string) ([]ConnectivityResult, error) {
+	u, err := parseServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []ConnectivityResult{
+		{Name: "cacerts", URL: (&url2.URL{Scheme: "https", Host: u.Host, Path: "/cacerts"}).String()},
+		{Name: "health", URL: (&url2.URL{Scheme: "https", Host: u.Host, Path: "/ping"}).String()},
+	}
+	for _, apiServer := range apiServers {
+		endpoints = append(endpoints, ConnectivityResult{Name: "apiserver", URL: apiServer})
+	}
+
+	for i := range endpoints {
+		checkEndpoint(ctx, &endpoints[i])
+	}
+	return endpoints, nil
+}
+
+func checkEndpoint(ctx context.Context, result *ConnectivityResult) {
+	address, err := serverAddress(result.URL)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	start := time.Now()
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 5 * time.Second},
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	result.Latency = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	conn.Close()
+	result.Reachable = true
+
+	client := newInsecureClient(nil)
+	defer client.CloseIdleConnections()
+
+	resp, err := probe(ctx, client, result.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+}
@@ -0,0 +1,68 @@
+package cacerts
+
+import (
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedHeaders never appear in a debug dump, the Authorization header holds
+// the token or its hash.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization"}
+
+// dumpTransport logs every request and response at debug level, see
+// Options.Debug.
+type dumpTransport struct {
+	next http.RoundTripper
+}
+
+func (d *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redacted := req.Clone(req.Context())
+	for _, header := range redactedHeaders {
+		if redacted.Header.Get(header) != "" {
+			redacted.Header.Set(header, "REDACTED")
+		}
+	}
+	// The body is left out so the request can still be sent
+	if dump, err := httputil.DumpRequestOut(redacted, false); err == nil {
+		logrus.Debugf("cacerts request:\n%s", dump)
+	}
+
+	resp, err := d.next.RoundTrip(req)
+	if err != nil {
+		logrus.Debugf("cacerts request to %s failed: %v", req.URL, err)
+		return nil, err
+	}
+	// Only the headers, reading the body here would bypass the limits of
+	// readBody, see debugBody
+	if dump, err := httputil.DumpResponse(resp, false); err == nil {
+		logrus.Debugf("cacerts response:\n%s", dump)
+	}
+	return resp, nil
+}
+
+// debugBody logs the body of resp as read by readBody, within its limit, if
+// Debug is set.
+func (o *Options) debugBody(resp *http.Response, data []byte) {
+	if o == nil || !o.Debug {
+		return
+	}
+	logrus.Debugf("cacerts response body from %s:\n%s", resp.Request.URL, data)
+}
+
+// debugTransport wraps transport with dumpTransport if Debug is set.
+func (o *Options) debugTransport(transport http.RoundTripper) http.RoundTripper {
+	if o == nil || !o.Debug {
+		return transport
+	}
+	return &dumpTransport{next: transport}
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the wrapped
+// transport.
+func (d *dumpTransport) CloseIdleConnections() {
+	if closer, ok := d.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,71 @@
+package cacerts
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// withDebugLogs captures the log entries of the rest of the test at debug
+// level.
+func withDebugLogs(t *testing.T) *test.Hook {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	hook := test.NewGlobal()
+	t.Cleanup(func() {
+		logrus.SetLevel(level)
+		logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	})
+	return hook
+}
+
+func TestDebugDump(t *testing.T) {
+	hook := withDebugLogs(t)
+	srv := newCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	}))
+
+	opts := testOptions()
+	opts.Debug = true
+	if _, _, err := Get(context.Background(), srv.URL, testToken, "/v3/ping", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodyLogged bool
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, testToken) || strings.Contains(entry.Message, hashBase64([]byte(testToken))) {
+			t.Errorf("the token was logged: %s", entry.Message)
+		}
+		bodyLogged = bodyLogged || strings.Contains(entry.Message, "pong")
+	}
+	if !bodyLogged {
+		t.Error("the body of the authenticated response was not logged")
+	}
+}
+
+func TestDebugDumpBodyLimit(t *testing.T) {
+	hook := withDebugLogs(t)
+	const limit = 4 << 10
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 1<<20))
+	}))
+	t.Cleanup(srv.Close)
+
+	opts := testOptions()
+	opts.Debug = true
+	opts.MaxBundleSize = limit
+	if _, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts); err == nil {
+		t.Fatal("CACerts() accepted a response over MaxBundleSize")
+	}
+	for _, entry := range hook.AllEntries() {
+		if len(entry.Message) > 2*limit {
+			t.Errorf("logged %d bytes, more than the limit of %d bytes of the body", len(entry.Message), limit)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package cacerts
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// CheckResult is the outcome of a single diagnostic check.
+type CheckResult struct {
+	OK      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (c *CheckResult) set(err error) {
+	c.OK = err == nil
+	if err != nil {
+		c.Error = err.Error()
+	}
+}
+
+// CertificateInfo describes one certificate of a CA bundle.
+type CertificateInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Expired     bool      `json:"expired"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// Diagnostics is a snapshot of every step of the bootstrap trust path.
+type Diagnostics struct {
+	Server string `json:"server"`
+	// Reachable is a plain TCP connection to the server.
+	Reachable CheckResult `json:"reachable"`
+	// Token is the X-Cattle-Hash handshake, which only succeeds if the server
+	// knows the token. It is always performed, even if the server is already
+	// trusted, see ValidateToken.
+	Token CheckResult `json:"token"`
+	// CACerts is the download and parsing of the CA bundle.
+	CACerts        CheckResult       `json:"cacerts"`
+	AlreadyTrusted bool              `json:"alreadyTrusted"`
+	Checksum       string            `json:"checksum,omitempty"`
+	Certificates   []CertificateInfo `json:"certificates,omitempty"`
+	// Expiry fails if any certificate of the bundle is expired.
+	Expiry CheckResult `json:"expiry"`
+}
+
+// Diagnose runs every check of the cluster token trust path against server and
+// records the results. Failing checks are recorded in the result, an error is
+// only returned if server can't be parsed.
+func Diagnose(ctx context.Context, server, token string) (*Diagnostics, error) {
+	address, err := serverAddress(server)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Diagnostics{
+		Server: server,
+	}
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err == nil {
+		conn.Close()
+	}
+	result.Reachable.set(err)
+	if err != nil {
+		result.Token.Skipped = true
+		result.CACerts.Skipped = true
+		result.Expiry.Skipped = true
+		return result, nil
+	}
+
+	// The download alone proves nothing about the token when the system roots
+	// already trust the server, so the handshake is checked on its own
+	result.Token.set(ValidateToken(ctx, server, token))
+
+	// Expired certificates are reported by the Expiry check rather than
+	// failing the download
+	downloaded, err := CACertsResult(ctx, server, token, true, &Options{AllowExpired: true})
+	if err != nil {
+		result.CACerts.set(err)
+		result.Expiry.Skipped = true
+		return result, nil
+	}
+
+	cacert := downloaded.CACert
+	result.AlreadyTrusted = downloaded.AlreadyTrusted
+	result.Checksum = downloaded.Checksum
+	if len(cacert) == 0 {
+		result.CACerts.OK = true
+		result.Expiry.Skipped = true
+		return result, nil
+	}
+
+	result.Certificates, err = describeCertificates(cacert, time.Now())
+	result.CACerts.set(err)
+	if err != nil {
+		result.Expiry.Skipped = true
+		return result, nil
+	}
+
+	result.Expiry.OK = true
+	for _, cert := range result.Certificates {
+		if cert.Expired {
+			result.Expiry.set(fmt.Errorf("certificate %s expired at %s", cert.Subject, cert.NotAfter))
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func describeCertificates(cacert []byte, now time.Time) ([]CertificateInfo, error) {
+	certs, err := parseCertificates(cacert, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []CertificateInfo
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		result = append(result, CertificateInfo{
+			Subject:     cert.Subject.String(),
+			Issuer:      cert.Issuer.String(),
+			NotBefore:   cert.NotBefore,
+			NotAfter:    cert.NotAfter,
+			Expired:     now.After(cert.NotAfter),
+			Fingerprint: hex.EncodeToString(sum[:]),
+		})
+	}
+	return result, nil
+}
+
+// ServerFingerprint connects to server without verifying it and returns the
+// SHA-256 fingerprint of the DER of the leaf certificate it presents, for
+// comparison with the one shown by Rancher. No token is needed and /cacerts is
+// not downloaded.
+func ServerFingerprint(ctx context.Context, server string) (string, error) {
+	address, err := serverAddress(server)
+	if err != nil {
+		return "", err
+	}
+
+	var opts *Options
+	tlsConfig := opts.tlsConfig()
+	tlsConfig.InsecureSkipVerify = true
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: opts.timeout()},
+		Config:    tlsConfig,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	peers := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return "", fmt.Errorf("%s presented no certificate", address)
+	}
+	sum := sha256.Sum256(peers[0].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// serverAddress returns the host:port to dial for server, defaulting to 443.
+func serverAddress(server string) (string, error) {
+	u, err := parseServer(server)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
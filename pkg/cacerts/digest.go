@@ -0,0 +1,59 @@
+package cacerts
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Digest is the hash used to compute the X-Cattle-Hash HMAC.
+type Digest struct {
+	Name string
+	New  func() hash.Hash
+}
+
+var (
+	DigestSHA256 = Digest{Name: "sha256", New: sha256.New}
+	DigestSHA384 = Digest{Name: "sha384", New: sha512.New384}
+	DigestSHA512 = Digest{Name: "sha512", New: sha512.New}
+
+	// DefaultDigest is what Rancher uses today.
+	DefaultDigest = DigestSHA512
+
+	digests = map[string]Digest{
+		DigestSHA256.Name: DigestSHA256,
+		DigestSHA384.Name: DigestSHA384,
+		DigestSHA512.Name: DigestSHA512,
+	}
+)
+
+// SelectedDigest returns the digest that will be used for opts, for
+// diagnostics.
+func SelectedDigest(opts *Options) Digest {
+	if opts == nil || opts.Digest.New == nil {
+		return DefaultDigest
+	}
+	return opts.Digest
+}
+
+// responseDigest picks the digest a cacerts response was hashed with from its
+// X-Cattle-Hash-Algorithm header, like "sha256" or "HMAC-SHA256". Without the
+// header it is the one of opts. A Digest set in opts is required, a response
+// announcing another one is rejected.
+func responseDigest(opts *Options, algorithm string) (Digest, error) {
+	if algorithm == "" {
+		return SelectedDigest(opts), nil
+	}
+
+	name := strings.ReplaceAll(strings.TrimPrefix(strings.ToLower(algorithm), "hmac-"), "-", "")
+	digest, ok := digests[name]
+	if !ok {
+		return Digest{}, fmt.Errorf("unsupported X-Cattle-Hash-Algorithm %q", algorithm)
+	}
+	if opts != nil && opts.Digest.New != nil && opts.Digest.Name != digest.Name {
+		return Digest{}, fmt.Errorf("server hashed cacerts with %s but %s is required", digest.Name, opts.Digest.Name)
+	}
+	return digest, nil
+}
@@ -0,0 +1,107 @@
+package cacerts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyHashDigests(t *testing.T) {
+	const (
+		token = "rancher-token"
+		nonce = "nonce"
+		body  = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	)
+
+	// Computed independently, with Python's hmac module
+	tests := []struct {
+		digest Digest
+		hash   string
+	}{
+		{
+			digest: DigestSHA256,
+			hash:   "0sK4Svvj3L37SmU030YqAZfaZLETKp0fLaXMLYBUs6M=",
+		},
+		{
+			digest: DigestSHA384,
+			hash:   "0xEI0knQFy9mxWq6XBTMmAPZYn51LgKjNpPFHGGJ9sJ9a+LblgzyKWbtNjQvWiZe",
+		},
+		{
+			digest: DigestSHA512,
+			hash:   "g0CSnMDWB9E0TGj54CwOiWLTW2xJGOwF2gVQKaFb0HDRHynJNK/wntTr8kHlApf9ju4zdI1aytJ0NPeyBUPe3A==",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.digest.Name, func(t *testing.T) {
+			if err := verifyHash(tt.digest, token, nonce, []byte(body), tt.hash); err != nil {
+				t.Errorf("verifyHash() error = %v", err)
+			}
+			if got := ExpectedHashDigest(tt.digest, token, nonce, []byte(body)); got != tt.hash {
+				t.Errorf("ExpectedHashDigest() = %s, want %s", got, tt.hash)
+			}
+			if err := verifyHash(tt.digest, token, "other nonce", []byte(body), tt.hash); err == nil {
+				t.Error("verifyHash() accepted the hash of another nonce")
+			}
+			for _, other := range tests {
+				if other.digest.Name == tt.digest.Name {
+					continue
+				}
+				if err := verifyHash(other.digest, token, nonce, []byte(body), tt.hash); err == nil {
+					t.Errorf("verifyHash() with %s accepted a %s hash", other.digest.Name, tt.digest.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseDigest(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		opts      *Options
+		want      Digest
+		wantErr   bool
+	}{
+		{algorithm: "", want: DigestSHA512},
+		{algorithm: "", opts: &Options{Digest: DigestSHA256}, want: DigestSHA256},
+		{algorithm: "sha256", want: DigestSHA256},
+		{algorithm: "HMAC-SHA384", want: DigestSHA384},
+		{algorithm: "SHA-512", want: DigestSHA512},
+		{algorithm: "sha256", opts: &Options{Digest: DigestSHA256}, want: DigestSHA256},
+		{algorithm: "sha256", opts: &Options{Digest: DigestSHA512}, wantErr: true},
+		{algorithm: "md5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			got, err := responseDigest(tt.opts, tt.algorithm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("responseDigest(%q) error = %v, wantErr %v", tt.algorithm, err, tt.wantErr)
+			}
+			if got.Name != tt.want.Name {
+				t.Errorf("responseDigest(%q) = %s, want %s", tt.algorithm, got.Name, tt.want.Name)
+			}
+		})
+	}
+}
+
+func TestCACertsDigestHeader(t *testing.T) {
+	ca := newTestCA(t, "rancher CA")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+			w.Header().Set("X-Cattle-Hash-Algorithm", "sha256")
+			w.Header().Set("X-Cattle-Hash", ExpectedHashDigest(DigestSHA256, testToken, nonce, ca.pem))
+		}
+		_, _ = w.Write(ca.pem)
+	}))
+	t.Cleanup(srv.Close)
+
+	cacert, _, err := CACerts(context.Background(), srv.URL, testToken, true, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cacert) != string(ca.pem) {
+		t.Errorf("CACerts() = %q, want the served CA", cacert)
+	}
+}
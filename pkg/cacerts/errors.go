@@ -0,0 +1,56 @@
+package cacerts
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrHashMissing is returned when a cacerts response has no X-Cattle-Hash,
+	// which Rancher omits when it doesn't know the token.
+	ErrHashMissing = errors.New("response has no X-Cattle-Hash header")
+	// ErrHashMismatch is returned when the X-Cattle-Hash of a cacerts response
+	// is not the HMAC of its content.
+	ErrHashMismatch = errors.New("response hash does not match")
+)
+
+// HTTPError is returned when a server answers with a status other than 200 OK,
+// so callers can tell a rejected token from a wrong path without matching
+// strings.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+func (h *HTTPError) Error() string {
+	return fmt.Sprintf("response %s from %s: %s", h.Status, h.URL, h.Body)
+}
+
+// TransportError is returned when a request did not get any response, because
+// of a DNS, connection or TLS failure.
+type TransportError struct {
+	URL string
+	Err error
+}
+
+func (t *TransportError) Error() string {
+	return t.Err.Error()
+}
+
+func (t *TransportError) Unwrap() error {
+	return t.Err
+}
+
+// isRetryable tells if err may go away on its own, like a refused connection
+// or a 5xx response.
+func isRetryable(err error) bool {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,45 @@
+package cacerts
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkExpiry fails if a certificate of cacert has expired, or only warns if
+// AllowExpired is set, and warns about certificates expiring within
+// ExpiryWarning. Only expiry is checked here, PEM blocks that are not
+// certificates or don't parse are skipped with a warning.
+func checkExpiry(cacert []byte, opts *Options) error {
+	now := time.Now()
+	for i, rest := 1, cacert; ; i++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			logrus.Warnf("Not checking the expiry of PEM block %d, it is a %s", i, block.Type)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			logrus.Warnf("Not checking the expiry of certificate %d: %v", i, err)
+			continue
+		}
+
+		switch {
+		case now.After(cert.NotAfter) && opts.AllowExpired:
+			logrus.Warnf("CA certificate %q expired on %s", cert.Subject, cert.NotAfter)
+		case now.After(cert.NotAfter):
+			return fmt.Errorf("CA certificate %q expired on %s", cert.Subject, cert.NotAfter)
+		case now.Before(cert.NotBefore):
+			logrus.Warnf("CA certificate %q is not valid before %s", cert.Subject, cert.NotBefore)
+		case opts.ExpiryWarning > 0 && cert.NotAfter.Sub(now) < opts.ExpiryWarning:
+			logrus.Warnf("CA certificate %q expires in %s, on %s", cert.Subject, cert.NotAfter.Sub(now).Round(time.Hour), cert.NotAfter)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package cacerts
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+	newCA := func(notBefore, notAfter time.Time) []byte {
+		return newTestCert(t, &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "rancher CA"},
+			IsCA:      true,
+			NotBefore: notBefore,
+			NotAfter:  notAfter,
+		}, nil).pem
+	}
+	valid := newCA(now.Add(-24*time.Hour), now.Add(365*24*time.Hour))
+	expiring := newCA(now.Add(-24*time.Hour), now.Add(3*24*time.Hour))
+	expired := newCA(now.Add(-48*time.Hour), now.Add(-24*time.Hour))
+	notYetValid := newCA(now.Add(24*time.Hour), now.Add(365*24*time.Hour))
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not checked")})
+	garbage := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")})
+
+	tests := []struct {
+		name        string
+		cacert      []byte
+		opts        *Options
+		wantErr     bool
+		wantWarning bool
+	}{
+		{
+			name:   "valid",
+			cacert: valid,
+		},
+		{
+			name:   "valid with a warning threshold",
+			cacert: valid,
+			opts:   &Options{ExpiryWarning: 30 * 24 * time.Hour},
+		},
+		{
+			name:        "expiring within the warning threshold",
+			cacert:      expiring,
+			opts:        &Options{ExpiryWarning: 30 * 24 * time.Hour},
+			wantWarning: true,
+		},
+		{
+			name:   "expiring without a warning threshold",
+			cacert: expiring,
+		},
+		{
+			name:    "expired",
+			cacert:  expired,
+			wantErr: true,
+		},
+		{
+			name:    "expired among valid certificates",
+			cacert:  append(append([]byte{}, valid...), expired...),
+			wantErr: true,
+		},
+		{
+			name:        "expired with AllowExpired",
+			cacert:      expired,
+			opts:        &Options{AllowExpired: true},
+			wantWarning: true,
+		},
+		{
+			name:        "not yet valid",
+			cacert:      notYetValid,
+			wantWarning: true,
+		},
+		{
+			name:        "other PEM blocks are skipped",
+			cacert:      append(append([]byte{}, valid...), privateKey...),
+			wantWarning: true,
+		},
+		{
+			name:        "certificates that don't parse are skipped",
+			cacert:      append(append([]byte{}, garbage...), valid...),
+			wantWarning: true,
+		},
+		{
+			name:        "expired after a certificate that doesn't parse",
+			cacert:      append(append([]byte{}, garbage...), expired...),
+			wantErr:     true,
+			wantWarning: true,
+		},
+	}
+
+	hook := test.NewGlobal()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			opts := tt.opts
+			if opts == nil {
+				opts = &Options{}
+			}
+
+			err := checkExpiry(tt.cacert, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			warned := false
+			for _, entry := range hook.AllEntries() {
+				warned = warned || entry.Level == logrus.WarnLevel
+			}
+			if warned != tt.wantWarning {
+				t.Errorf("checkExpiry() warned %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCACertsExpired(t *testing.T) {
+	expired := newTestCert(t, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "rancher CA"},
+		IsCA:      true,
+		NotBefore: time.Now().Add(-48 * time.Hour),
+		NotAfter:  time.Now().Add(-24 * time.Hour),
+	}, nil)
+	srv := newCACertsServer(t, testToken, expired.pem, nil)
+
+	if _, _, err := CACerts(context.Background(), srv.URL, testToken, true, testOptions()); err == nil {
+		t.Fatal("CACerts() accepted an expired CA")
+	}
+
+	opts := testOptions()
+	opts.AllowExpired = true
+	cacert, _, err := CACerts(context.Background(), srv.URL, testToken, true, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cacert) != string(expired.pem) {
+		t.Errorf("CACerts() with AllowExpired returned %q, want the expired CA", cacert)
+	}
+}
+
+func TestCACertsUnparsedBlocks(t *testing.T) {
+	// Only expiry fails a download, a bundle with other PEM blocks is returned
+	// as served
+	ca := newTestCA(t, "rancher CA")
+	bundle := append(append([]byte{}, ca.pem...), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: []byte("not checked")})...)
+	srv := newCACertsServer(t, testToken, bundle, nil)
+
+	cacert, _, err := CACerts(context.Background(), srv.URL, testToken, true, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cacert) != string(bundle) {
+		t.Errorf("CACerts() = %q, want the served bundle", cacert)
+	}
+}
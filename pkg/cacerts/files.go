@@ -0,0 +1,96 @@
+package cacerts
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+)
+
+// FileDefaults are the conventions applied to every applyinator.File emitted by
+// this package. The content is always base64 encoded since that is the only
+// encoding the system-agent understands.
+type FileDefaults struct {
+	// PathPrefix is prepended to every path, for instance to target an image
+	// root rather than the running system.
+	PathPrefix string
+	// Permissions of the emitted files, "0644" if empty.
+	Permissions string
+	// UID and GID own the emitted files. The system-agent always chowns the
+	// files it writes, so the zero value means root:root rather than the uid
+	// of the agent.
+	UID int
+	GID int
+}
+
+var (
+	fileDefaultsLock sync.Mutex
+	fileDefaults     = FileDefaults{
+		Permissions: "0644",
+	}
+)
+
+// SetFileDefaults replaces the conventions used for emitted files.
+func SetFileDefaults(defaults FileDefaults) {
+	if defaults.Permissions == "" {
+		defaults.Permissions = "0644"
+	}
+
+	fileDefaultsLock.Lock()
+	defer fileDefaultsLock.Unlock()
+	fileDefaults = defaults
+}
+
+// GetFileDefaults returns the conventions used for emitted files.
+func GetFileDefaults() FileDefaults {
+	fileDefaultsLock.Lock()
+	defer fileDefaultsLock.Unlock()
+	return fileDefaults
+}
+
+// prefixPath returns where path ends up once the PathPrefix is applied.
+func (f FileDefaults) prefixPath(path string) string {
+	if f.PathPrefix == "" {
+		return path
+	}
+	return filepath.Join(f.PathPrefix, path)
+}
+
+// anchorFile returns cacert as the trust anchor of store, at the AnchorPath
+// and with the AnchorPermissions of opts if set. Every path emitting an anchor
+// goes through here, so a bundle over the limits of opts is never written.
+func (o *Options) anchorFile(store trustStore, cacert []byte) (*applyinator.File, error) {
+	if err := checkBundleLimits(cacert, o); err != nil {
+		return nil, err
+	}
+
+	file := store.toFile(cacert)
+	if o == nil {
+		return file, nil
+	}
+	if o.AnchorPath != "" {
+		file.Path = o.AnchorPath
+	}
+	if o.AnchorPermissions != "" {
+		mode, err := strconv.ParseUint(o.AnchorPermissions, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, fmt.Errorf("invalid anchor permissions %q, expected an octal mode like 0644", o.AnchorPermissions)
+		}
+		file.Permissions = o.AnchorPermissions
+	}
+	return file, nil
+}
+
+func newFile(path string, content []byte) *applyinator.File {
+	defaults := GetFileDefaults()
+	return &applyinator.File{
+		Content:     base64.StdEncoding.EncodeToString(content),
+		Path:        defaults.prefixPath(path),
+		Permissions: defaults.Permissions,
+		UID:         defaults.UID,
+		GID:         defaults.GID,
+	}
+}
@@ -0,0 +1,39 @@
+package cacerts
+
+import (
+	"net/http"
+
+	"github.com/rancher/rancherd/pkg/version"
+)
+
+// protectedHeaders carry the cacerts protocol and can't be set through Header.
+var protectedHeaders = []string{
+	"Authorization",
+	"X-Cattle-Nonce",
+}
+
+// header returns the headers of every request, the default User-Agent and the
+// Header of opts.
+func (o *Options) header() http.Header {
+	header := http.Header{}
+	header.Set("User-Agent", "rancherd/"+version.Version)
+	if o == nil {
+		return header
+	}
+
+	for key, values := range o.Header {
+		header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	for _, key := range protectedHeaders {
+		header.Del(key)
+	}
+	return header
+}
+
+// setHeaders adds the headers of opts to req, before the protocol headers are
+// set.
+func (o *Options) setHeaders(req *http.Request) {
+	for key, values := range o.header() {
+		req.Header[key] = values
+	}
+}
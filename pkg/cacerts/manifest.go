@@ -0,0 +1,84 @@
+package cacerts
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/wrangler/pkg/yaml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const defaultManifestKey = "ca.crt"
+
+// ToConfigMap wraps the CA bundle in a ConfigMap so it can be mounted into
+// workloads. The PEM is stored under key, or "ca.crt" if key is empty.
+func ToConfigMap(cacert []byte, namespace, name, key string) (*corev1.ConfigMap, error) {
+	if len(cacert) == 0 {
+		return nil, fmt.Errorf("no CA certs to put in configmap %s/%s", namespace, name)
+	}
+	if key == "" {
+		key = defaultManifestKey
+	}
+
+	return &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: map[string]string{
+			key: string(cacert),
+		},
+	}, nil
+}
+
+// ToSecret is the same as ToConfigMap but produces an Opaque Secret.
+func ToSecret(cacert []byte, namespace, name, key string) (*corev1.Secret, error) {
+	if len(cacert) == 0 {
+		return nil, fmt.Errorf("no CA certs to put in secret %s/%s", namespace, name)
+	}
+	if key == "" {
+		key = defaultManifestKey
+	}
+
+	return &corev1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			key: cacert,
+		},
+	}, nil
+}
+
+// ToManifest downloads the cluster CA and renders it as a YAML ConfigMap, or a
+// Secret if asSecret is set.
+func ToManifest(ctx context.Context, server, token, namespace, name, key string, asSecret bool, opts *Options) ([]byte, error) {
+	cacert, _, err := CACerts(ctx, server, token, true, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj runtime.Object
+	if asSecret {
+		obj, err = ToSecret(cacert, namespace, name, key)
+	} else {
+		obj, err = ToConfigMap(cacert, namespace, name, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.ToBytes([]runtime.Object{obj})
+}
@@ -0,0 +1,83 @@
+package cacerts
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Failure reasons passed to Metrics.IncFailure.
+const (
+	// FailureTransport is a request that got no response, like a refused
+	// connection or a DNS failure.
+	FailureTransport = "transport"
+	// FailureStatus4xx is a 4xx response, usually a rejected token.
+	FailureStatus4xx = "status_4xx"
+	// FailureStatus5xx is a 5xx response.
+	FailureStatus5xx = "status_5xx"
+	// FailureHashMismatch is a cacerts response with a missing or wrong
+	// X-Cattle-Hash.
+	FailureHashMismatch = "hash_mismatch"
+	// FailureTLS is a TLS handshake or certificate verification failure.
+	FailureTLS = "tls"
+	// FailureOther is anything else, like an invalid option or a CA that
+	// doesn't match CAFingerprint.
+	FailureOther = "other"
+)
+
+// Metrics receives instrumentation of cacerts operations, so it can be wired
+// to Prometheus or any other sink without this package depending on it.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveDuration is called with how long each CACerts call took, failed
+	// or not.
+	ObserveDuration(time.Duration)
+	// IncFailure is called once per failed CACerts call or authenticated
+	// request, with one of the Failure reasons.
+	IncFailure(reason string)
+	// IncRetry is called before every retry, of the cacerts download or of a
+	// rate limited request.
+	IncRetry()
+}
+
+func (o *Options) observeDuration(start time.Time) {
+	if o != nil && o.Metrics != nil {
+		o.Metrics.ObserveDuration(time.Since(start))
+	}
+}
+
+func (o *Options) incFailure(err error) {
+	if o != nil && o.Metrics != nil && err != nil {
+		o.Metrics.IncFailure(failureReason(err))
+	}
+}
+
+func (o *Options) incRetry() {
+	if o != nil && o.Metrics != nil {
+		o.Metrics.IncRetry()
+	}
+}
+
+// failureReason maps err to one of the Failure reasons.
+func failureReason(err error) string {
+	var (
+		httpErr      *HTTPError
+		transportErr *TransportError
+		recordErr    tls.RecordHeaderError
+	)
+	switch {
+	case errors.Is(err, ErrHashMissing) || errors.Is(err, ErrHashMismatch):
+		return FailureHashMismatch
+	case errors.As(err, &httpErr):
+		if httpErr.StatusCode >= http.StatusInternalServerError {
+			return FailureStatus5xx
+		}
+		return FailureStatus4xx
+	case isVerificationError(err) || errors.As(err, &recordErr):
+		return FailureTLS
+	case errors.As(err, &transportErr):
+		return FailureTransport
+	}
+	return FailureOther
+}
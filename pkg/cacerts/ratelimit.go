@@ -0,0 +1,30 @@
+package cacerts
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter is shared by every outbound request of the package, including the
+// retries, so it caps the total request rate of the process.
+var limiter = rate.NewLimiter(rate.Inf, 0)
+
+// SetRateLimit caps the outbound requests made by this package to qps requests
+// per second with the given burst. A qps of zero or less removes the limit,
+// which is the default.
+func SetRateLimit(qps float64, burst int) {
+	if qps <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	limiter.SetBurst(burst)
+	limiter.SetLimit(rate.Limit(qps))
+}
+
+func waitRateLimit(ctx context.Context) error {
+	return limiter.Wait(ctx)
+}
@@ -0,0 +1,79 @@
+package cacerts
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParseRegistration splits a registration string copied from Rancher into the
+// server, token and optional CA fingerprint. Two forms are accepted:
+//
+//	https://rancher.example.com/<token>[/<fingerprint>]
+//	... --server https://rancher.example.com --token <token> [--ca-checksum <fingerprint>]
+//
+// The second is the tail of the system-agent install command. In the first the
+// last path segment is only taken as the fingerprint if it is a hex SHA-256,
+// so tokens may contain slashes. The fingerprint can be checked with
+// VerifyCACerts.
+func ParseRegistration(s string) (server, token, fingerprint string, err error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "--server") || strings.Contains(s, "--token") {
+		return parseRegistrationFlags(s)
+	}
+
+	u, err := parseServer(s)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) > 1 && isFingerprint(segments[len(segments)-1]) {
+		fingerprint = segments[len(segments)-1]
+		segments = segments[:len(segments)-1]
+	}
+	token = strings.Join(segments, "/")
+	if token == "" {
+		return "", "", "", fmt.Errorf("no token found in registration %s://%s", u.Scheme, u.Host)
+	}
+
+	return u.Scheme + "://" + u.Host, token, fingerprint, nil
+}
+
+func parseRegistrationFlags(s string) (server, token, fingerprint string, err error) {
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok && i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		value = strings.Trim(value, `"'`)
+
+		switch name {
+		case "--server":
+			server = value
+		case "--token":
+			token = value
+		case "--ca-checksum":
+			fingerprint = value
+		}
+	}
+
+	if server == "" || token == "" {
+		return "", "", "", fmt.Errorf("registration command needs both --server and --token")
+	}
+	u, err := parseServer(server)
+	if err != nil {
+		return "", "", "", err
+	}
+	return u.Scheme + "://" + u.Host, token, fingerprint, nil
+}
+
+func isFingerprint(s string) bool {
+	s = normalizeFingerprint(s)
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
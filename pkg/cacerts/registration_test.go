@@ -0,0 +1,101 @@
+package cacerts
+
+import "testing"
+
+func TestParseRegistration(t *testing.T) {
+	const (
+		token       = "q8x2m4kzj7wpd9r5cbf6ht3nvl"
+		fingerprint = "3f1c5e8a9b2d4f6071829a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f"
+	)
+
+	tests := []struct {
+		name            string
+		registration    string
+		wantServer      string
+		wantToken       string
+		wantFingerprint string
+		wantErr         bool
+	}{
+		{
+			name:         "url with token",
+			registration: "https://rancher.example.com/" + token,
+			wantServer:   "https://rancher.example.com",
+			wantToken:    token,
+		},
+		{
+			name:            "url with token and fingerprint",
+			registration:    "https://rancher.example.com:8443/" + token + "/" + fingerprint + "\n",
+			wantServer:      "https://rancher.example.com:8443",
+			wantToken:       token,
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:         "token with slashes",
+			registration: "https://rancher.example.com/c-m-abc12/" + token,
+			wantServer:   "https://rancher.example.com",
+			wantToken:    "c-m-abc12/" + token,
+		},
+		{
+			name:            "token with slashes and fingerprint",
+			registration:    "https://rancher.example.com/c-m-abc12/" + token + "/" + fingerprint,
+			wantServer:      "https://rancher.example.com",
+			wantToken:       "c-m-abc12/" + token,
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:         "token that looks like a fingerprint",
+			registration: "https://rancher.example.com/" + fingerprint,
+			wantServer:   "https://rancher.example.com",
+			wantToken:    fingerprint,
+		},
+		{
+			name:         "bare host",
+			registration: "rancher.example.com/" + token,
+			wantServer:   "https://rancher.example.com",
+			wantToken:    token,
+		},
+		{
+			name: "system-agent install command",
+			registration: "curl -fL https://rancher.example.com/system-agent-install.sh | sudo sh -s - " +
+				"--server https://rancher.example.com --label 'cattle.io/os=linux' --token " + token +
+				" --ca-checksum " + fingerprint + " --etcd --controlplane --worker",
+			wantServer:      "https://rancher.example.com",
+			wantToken:       token,
+			wantFingerprint: fingerprint,
+		},
+		{
+			name:         "flags with equal signs and quotes",
+			registration: `--server="https://rancher.example.com/" --token='` + token + `'`,
+			wantServer:   "https://rancher.example.com",
+			wantToken:    token,
+		},
+		{
+			name:         "url without token",
+			registration: "https://rancher.example.com/",
+			wantErr:      true,
+		},
+		{
+			name:         "flags without token",
+			registration: "--server https://rancher.example.com --ca-checksum " + fingerprint,
+			wantErr:      true,
+		},
+		{
+			name:         "empty",
+			registration: "",
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, token, fingerprint, err := ParseRegistration(tt.registration)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRegistration() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if server != tt.wantServer || token != tt.wantToken || fingerprint != tt.wantFingerprint {
+				t.Errorf("ParseRegistration() = %q, %q, %q, want %q, %q, %q",
+					server, token, fingerprint, tt.wantServer, tt.wantToken, tt.wantFingerprint)
+			}
+		})
+	}
+}
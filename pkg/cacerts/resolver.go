@@ -0,0 +1,51 @@
+package cacerts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rancher/rancherd/pkg/tpm"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenResolver turns a machine token into the token sent to the server, for
+// backends sealing the token elsewhere than in a TPM, like a KMS, or for stubs
+// in tests. The TPM is used if no TokenResolver is set.
+type TokenResolver interface {
+	// Resolve returns the token to send for token. isSpecial makes the request
+	// go through TPM attestation with the resolved token, as for a tpm://
+	// token, otherwise the resolved token is sent as a bearer token.
+	Resolve(token string) (isSpecial bool, resolved string, err error)
+}
+
+func (o *Options) tokenResolver(ctx context.Context) TokenResolver {
+	if o != nil && o.TokenResolver != nil {
+		return o.TokenResolver
+	}
+	return tpmResolver{ctx: ctx, opts: o}
+}
+
+// tpmResolver is the default TokenResolver. It replaces a tpm:// token with the
+// hash of the EK of the TPM, falling back to a bearer token if allowed by
+// TPMFallback and the node has no TPM. Any other token is passed through.
+type tpmResolver struct {
+	ctx  context.Context
+	opts *Options
+}
+
+func (t tpmResolver) Resolve(token string) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, t.opts.tpmTimeout())
+	defer cancel()
+	isTPM, resolved, err := tpm.ResolveTokenContext(ctx, token)
+	if err == nil || t.opts == nil || !t.opts.TPMFallback || !tpm.IsNotAvailable(err) {
+		return isTPM, resolved, err
+	}
+
+	bearer := strings.TrimPrefix(token, "tpm://")
+	if bearer == "" {
+		return false, "", fmt.Errorf("no TPM device and the tpm:// token has no bearer token to fall back to: %w", err)
+	}
+	logrus.Infof("No TPM device found, falling back to the token as a bearer token without TPM attestation")
+	return false, bearer, nil
+}
@@ -0,0 +1,111 @@
+package cacerts
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRateLimitRetries is how many times a 429 response is retried.
+	DefaultRateLimitRetries = 5
+
+	rateLimitInitialDelay = time.Second
+	rateLimitMaxDelay     = 30 * time.Second
+)
+
+// RetryPolicy is how a failed cacerts download is retried, doubling the delay
+// after each attempt.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, 1 disables retrying.
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy covers the usual race with a server that is still booting.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:     5,
+	InitialDelay: time.Second,
+	MaxDelay:     16 * time.Second,
+}
+
+func (o *Options) retryPolicy() RetryPolicy {
+	if o == nil || o.Retry == nil {
+		return DefaultRetryPolicy
+	}
+	return *o.Retry
+}
+
+func caCertsWithRetry(ctx context.Context, server, token string, clusterToken bool, opts *Options) ([]byte, string, error) {
+	policy := opts.retryPolicy()
+	delay := policy.InitialDelay
+
+	for attempt := 1; ; attempt++ {
+		cacert, checksum, err := caCerts(ctx, server, token, clusterToken, opts)
+		if err == nil || !isRetryable(err) || attempt >= policy.Attempts || ctx.Err() != nil {
+			return cacert, checksum, err
+		}
+
+		logrus.Debugf("Attempt %d/%d to get cacerts from %s failed, retrying in %s: %v", attempt, policy.Attempts, server, delay, err)
+		opts.incRetry()
+		if err := sleep(ctx, delay); err != nil {
+			return nil, "", err
+		}
+
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
+
+func (o *Options) rateLimitRetries() int {
+	switch {
+	case o == nil || o.RateLimitRetries == 0:
+		return DefaultRateLimitRetries
+	case o.RateLimitRetries < 0:
+		return 0
+	}
+	return o.RateLimitRetries
+}
+
+// rateLimitDelay honors the Retry-After header of a 429 response, given either
+// in seconds or as an HTTP date, and otherwise backs off exponentially.
+func rateLimitDelay(resp *http.Response, attempt int) time.Duration {
+	delay := rateLimitInitialDelay << attempt
+	if delay <= 0 || delay > rateLimitMaxDelay {
+		delay = rateLimitMaxDelay
+	}
+
+	retryAfter := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		delay = time.Until(date)
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > rateLimitMaxDelay {
+		return rateLimitMaxDelay
+	}
+	return delay
+}
+
+// sleep waits for delay or until ctx is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package cacerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// checkRevocation fails if any certificate of the bundle is revoked according
+// to its CRL distribution points or, if it has none, its OCSP responders.
+// Self-signed roots are skipped, and certificates whose issuer isn't part of
+// the bundle can't be verified and are only logged.
+func checkRevocation(ctx context.Context, cacert []byte, opts *Options) error {
+	certs, err := parseCertificates(cacert, opts)
+	if err != nil {
+		return err
+	}
+
+	// The responders are reached like the server, through the Proxy, Resolver
+	// and Transport of opts
+	client := &http.Client{
+		Timeout:   opts.timeout(),
+		Transport: newTransport(opts.tlsConfig(), opts),
+	}
+	defer client.CloseIdleConnections()
+
+	for _, cert := range certs {
+		if len(cert.CRLDistributionPoints) == 0 && len(cert.OCSPServer) == 0 {
+			continue
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			continue
+		}
+
+		issuer := findIssuer(cert, certs)
+		if issuer == nil {
+			logrus.Warnf("Can not check revocation of %s, its issuer is not in the CA bundle", cert.Subject)
+			continue
+		}
+
+		if len(cert.CRLDistributionPoints) > 0 {
+			err = checkCRL(ctx, client, cert, issuer)
+		} else {
+			err = checkOCSP(ctx, client, cert, issuer)
+		}
+		if err != nil {
+			return fmt.Errorf("checking revocation of %s: %w", cert.Subject, err)
+		}
+	}
+
+	return nil
+}
+
+func findIssuer(cert *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range certs {
+		if bytes.Equal(cert.RawIssuer, candidate.RawSubject) && cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func checkCRL(ctx context.Context, client *http.Client, cert, issuer *x509.Certificate) error {
+	var lastErr error
+	for _, url := range cert.CRLDistributionPoints {
+		data, err := fetchRevocation(ctx, client, http.MethodGet, url, "", nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			lastErr = fmt.Errorf("parsing CRL from %s: %w", url, err)
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			lastErr = fmt.Errorf("verifying CRL from %s: %w", url, err)
+			continue
+		}
+		// A stale CRL may not list recent revocations
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			lastErr = fmt.Errorf("CRL from %s expired at %s", url, crl.NextUpdate)
+			continue
+		}
+
+		for _, revoked := range crl.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("certificate is revoked according to %s", url)
+			}
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func checkOCSP(ctx context.Context, client *http.Client, cert, issuer *x509.Certificate) error {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, url := range cert.OCSPServer {
+		data, err := fetchRevocation(ctx, client, http.MethodPost, url, "application/ocsp-request", request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := ocsp.ParseResponseForCert(data, cert, issuer)
+		if err != nil {
+			lastErr = fmt.Errorf("parsing OCSP response from %s: %w", url, err)
+			continue
+		}
+
+		switch resp.Status {
+		case ocsp.Good:
+			return nil
+		case ocsp.Revoked:
+			return fmt.Errorf("certificate is revoked according to %s", url)
+		}
+		lastErr = fmt.Errorf("OCSP responder %s does not know the certificate", url)
+	}
+	return lastErr
+}
+
+func fetchRevocation(ctx context.Context, client *http.Client, method, url, contentType string, body []byte) ([]byte, error) {
+	if err := waitRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readBody(resp, maxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response %d from %s", resp.StatusCode, url)
+	}
+	return data, nil
+}
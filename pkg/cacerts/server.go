@@ -0,0 +1,40 @@
+package cacerts
+
+import (
+	"fmt"
+	"net"
+	url2 "net/url"
+	"strings"
+)
+
+// parseServer turns the server setting into a URL. Besides full URLs it
+// accepts a bare host or host:port, which default to https, and IPv6 literals
+// with or without brackets.
+func parseServer(server string) (*url2.URL, error) {
+	server = strings.TrimSpace(server)
+	if !strings.Contains(server, "://") {
+		if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+			server = "[" + server + "]"
+		}
+		server = "https://" + server
+	}
+
+	u, err := url2.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server %q: %w", server, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host found in server %q", server)
+	}
+	return u, nil
+}
+
+// cacertsURL returns the URL the CA of server is downloaded from, with the
+// cluster or machine cacerts path of opts.
+func cacertsURL(server string, clusterToken bool, opts *Options) (string, error) {
+	u, err := parseServer(server)
+	if err != nil {
+		return "", err
+	}
+	return (&url2.URL{Scheme: "https", Host: u.Host, Path: opts.caCertsPath(clusterToken)}).String(), nil
+}
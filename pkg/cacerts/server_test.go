@@ -0,0 +1,103 @@
+package cacerts
+
+import "testing"
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		server     string
+		want       string
+		wantCACert string
+		wantErr    bool
+	}{
+		{
+			server:     "rancher.example.com",
+			want:       "https://rancher.example.com",
+			wantCACert: "https://rancher.example.com/cacerts",
+		},
+		{
+			server:     "rancher.example.com:8443",
+			want:       "https://rancher.example.com:8443",
+			wantCACert: "https://rancher.example.com:8443/cacerts",
+		},
+		{
+			server:     "https://rancher.example.com",
+			want:       "https://rancher.example.com",
+			wantCACert: "https://rancher.example.com/cacerts",
+		},
+		{
+			server:     "https://rancher.example.com/",
+			want:       "https://rancher.example.com/",
+			wantCACert: "https://rancher.example.com/cacerts",
+		},
+		{
+			server:     "https://rancher.example.com/some/path",
+			want:       "https://rancher.example.com/some/path",
+			wantCACert: "https://rancher.example.com/cacerts",
+		},
+		{
+			server:     " 10.0.0.1:443\n",
+			want:       "https://10.0.0.1:443",
+			wantCACert: "https://10.0.0.1:443/cacerts",
+		},
+		{
+			server:     "10.0.0.1",
+			want:       "https://10.0.0.1",
+			wantCACert: "https://10.0.0.1/cacerts",
+		},
+		{
+			server:     "fd00::1",
+			want:       "https://[fd00::1]",
+			wantCACert: "https://[fd00::1]/cacerts",
+		},
+		{
+			server:     "[fd00::1]",
+			want:       "https://[fd00::1]",
+			wantCACert: "https://[fd00::1]/cacerts",
+		},
+		{
+			server:     "[fd00::1]:8443",
+			want:       "https://[fd00::1]:8443",
+			wantCACert: "https://[fd00::1]:8443/cacerts",
+		},
+		{
+			server:     "https://[fd00::1]:8443/",
+			want:       "https://[fd00::1]:8443/",
+			wantCACert: "https://[fd00::1]:8443/cacerts",
+		},
+		{
+			server:  "",
+			wantErr: true,
+		},
+		{
+			server:  "https://",
+			wantErr: true,
+		},
+		{
+			server:  "https://[fd00::1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			u, err := parseServer(tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServer(%q) error = %v, wantErr %v", tt.server, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := u.String(); got != tt.want {
+				t.Errorf("parseServer(%q) = %s, want %s", tt.server, got, tt.want)
+			}
+
+			got, err := cacertsURL(tt.server, true, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wantCACert {
+				t.Errorf("cacertsURL(%q) = %s, want %s", tt.server, got, tt.wantCACert)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package cacerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Summary is the outcome of a cacerts fetch for scripts, see Summarize.
+type Summary struct {
+	Server         string `json:"server"`
+	AlreadyTrusted bool   `json:"alreadyTrusted"`
+	Checksum       string `json:"checksum,omitempty"`
+	Certificates   int    `json:"certificates"`
+	// EarliestExpiry is the NotAfter of the first certificate of the bundle to
+	// expire, nil if no CA was downloaded.
+	EarliestExpiry *time.Time `json:"earliestExpiry,omitempty"`
+	// TPM is set if a tpm:// token was resolved through the TPM.
+	TPM bool `json:"tpm"`
+}
+
+// Summarize downloads the CA of server like CACerts and summarizes the result.
+// A tpm:// token is resolved as for MachineGet when clusterToken is false.
+func Summarize(ctx context.Context, server, token string, clusterToken bool, opts *Options) (*Summary, error) {
+	token, err := resolveFileToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{
+		Server: server,
+	}
+	if !clusterToken {
+		summary.TPM, token, err = resolveToken(ctx, token, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := CACertsResult(ctx, server, token, clusterToken, opts)
+	if err != nil {
+		return nil, err
+	}
+	summary.AlreadyTrusted = result.AlreadyTrusted
+	summary.Checksum = result.Checksum
+	if len(result.CACert) == 0 {
+		return summary, nil
+	}
+
+	certs, err := parseCertificates(result.CACert, opts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cacerts from %s: %w", server, err)
+	}
+	summary.Certificates = len(certs)
+	for _, cert := range certs {
+		if summary.EarliestExpiry == nil || cert.NotAfter.Before(*summary.EarliestExpiry) {
+			notAfter := cert.NotAfter
+			summary.EarliestExpiry = &notAfter
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,68 @@
+package cacerts
+
+import (
+	"context"
+	"time"
+)
+
+// Timings breaks down one cacerts fetch. Phases that didn't happen, for
+// instance everything past the probe when the server is already trusted, are
+// zero.
+type Timings struct {
+	// Probe is the time spent checking if the server is already trusted.
+	Probe time.Duration `json:"probe"`
+	// Handshake is the time until the response headers of the X-Cattle-Nonce
+	// request arrived, including the TCP and TLS setup.
+	Handshake time.Duration `json:"handshake"`
+	// Download is the time spent reading the response body.
+	Download time.Duration `json:"download"`
+	// Verify is the time spent checking the X-Cattle-Hash.
+	Verify time.Duration `json:"verify"`
+}
+
+func (t Timings) Total() time.Duration {
+	return t.Probe + t.Handshake + t.Download + t.Verify
+}
+
+func (o *Options) reportTimings(t Timings) {
+	if o != nil && o.OnTimings != nil {
+		o.OnTimings(t)
+	}
+}
+
+// MeasureCACerts runs CACerts once and returns how long each phase took.
+func MeasureCACerts(ctx context.Context, server, token string, clusterToken bool, opts *Options) (Timings, error) {
+	var (
+		result   Timings
+		measured Options
+	)
+	if opts != nil {
+		measured = *opts
+	}
+	measured.OnTimings = func(t Timings) {
+		result = t
+		if opts != nil && opts.OnTimings != nil {
+			opts.OnTimings(t)
+		}
+	}
+
+	_, _, err := CACerts(ctx, server, token, clusterToken, &measured)
+	return result, err
+}
+
+// EstimateBootstrapTime models how long the cacerts step takes for nodes
+// bootstrapping against one server, concurrency at a time, given a sample
+// from MeasureCACerts. Nodes are assumed to go in waves of concurrency nodes
+// that each take the sampled total, so the estimate is only as good as the
+// assumption that the server doesn't slow down under that concurrency.
+// Measure the sample under representative load to account for that.
+func EstimateBootstrapTime(sample Timings, nodes, concurrency int) time.Duration {
+	if nodes <= 0 {
+		return 0
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	waves := (nodes + concurrency - 1) / concurrency
+	return time.Duration(waves) * sample.Total()
+}
@@ -0,0 +1,127 @@
+package cacerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rancher/rancherd/pkg/tpm"
+	"github.com/rancher/wrangler/pkg/randomtoken"
+)
+
+const fileTokenPrefix = "file://"
+
+// TokenFromFile reads a token from path, dropping surrounding whitespace and
+// newlines.
+func TokenFromFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// resolveFileToken replaces a file:// reference with the token in that file,
+// any other token is returned as is.
+func resolveFileToken(token string) (string, error) {
+	if !strings.HasPrefix(token, fileTokenPrefix) {
+		return token, nil
+	}
+	return TokenFromFile(strings.TrimPrefix(token, fileTokenPrefix))
+}
+
+// normalizeToken drops the whitespace around token, typically a trailing
+// newline from a heredoc, which would otherwise change the HMAC and only show
+// up as a hash mismatch.
+func normalizeToken(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("token is empty")
+	}
+	return token, nil
+}
+
+// tokenEntropy estimates the entropy of token in bits as its length times the
+// Shannon entropy of its character distribution. This only looks at the token
+// itself, so it overestimates structured or dictionary based tokens but
+// reliably flags short or repetitive ones.
+func tokenEntropy(token string) float64 {
+	if token == "" {
+		return 0
+	}
+
+	counts := map[rune]int{}
+	length := 0
+	for _, r := range token {
+		counts[r]++
+		length++
+	}
+
+	perChar := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(length)
+		perChar -= p * math.Log2(p)
+	}
+	return perChar * float64(length)
+}
+
+// checkTokenStrength enforces the optional MinTokenLength and MinTokenEntropy
+// policy before the token is used as the HMAC key.
+func checkTokenStrength(token string, opts *Options) error {
+	if opts == nil {
+		return nil
+	}
+	if length := utf8.RuneCountInString(token); opts.MinTokenLength > 0 && length < opts.MinTokenLength {
+		return fmt.Errorf("token is %d characters, the minimum is %d", length, opts.MinTokenLength)
+	}
+	if opts.MinTokenEntropy > 0 {
+		if entropy := tokenEntropy(token); entropy < opts.MinTokenEntropy {
+			return fmt.Errorf("token has an estimated %.1f bits of entropy, the minimum is %.1f", entropy, opts.MinTokenEntropy)
+		}
+	}
+	return nil
+}
+
+// ValidateToken checks token against server with the cacerts handshake, even
+// if the server is already trusted, without writing anything. A tpm:// token
+// is resolved and checked on the machine path, a file:// token is read first.
+func ValidateToken(ctx context.Context, server, token string) error {
+	token, err := resolveFileToken(token)
+	if err != nil {
+		return err
+	}
+
+	tpmCtx, cancel := context.WithTimeout(ctx, DefaultTPMTimeout)
+	isTPM, token, err := tpm.ResolveTokenContext(tpmCtx, token)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	// A fresh nonce that is set up front skips the trust probes, which would
+	// succeed without ever looking at the token
+	nonce, err := randomtoken.Generate()
+	if err != nil {
+		return err
+	}
+	_, _, err = caCertsWithRetry(ctx, server, token, !isTPM, &Options{fixedNonce: nonce})
+
+	var httpErr *HTTPError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrHashMissing) || errors.Is(err, ErrHashMismatch),
+		errors.As(err, &httpErr) && (httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden):
+		return fmt.Errorf("token rejected by %s: %w", server, err)
+	}
+	return fmt.Errorf("validating token against %s: %w", server, err)
+}
@@ -0,0 +1,72 @@
+package cacerts
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTokenWhitespace(t *testing.T) {
+	srv := newCACertsServer(t, testToken, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+base64.StdEncoding.EncodeToString([]byte(testToken)) {
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("pong"))
+	}))
+
+	for _, token := range []string{testToken + "\n", testToken + "\r\n", " " + testToken + "\t"} {
+		t.Run(fmt.Sprintf("cluster %q", token), func(t *testing.T) {
+			opts := testOptions()
+			if _, _, err := CACerts(context.Background(), srv.URL, token, true, opts); err != nil {
+				t.Errorf("CACerts() with token %q: %v", token, err)
+			}
+		})
+
+		t.Run(fmt.Sprintf("machine %q", token), func(t *testing.T) {
+			opts := testOptions()
+			data, _, err := MachineGet(context.Background(), srv.URL, token, "/v1/ping", opts)
+			if err != nil {
+				t.Fatalf("MachineGet() with token %q: %v", token, err)
+			}
+			if string(data) != "pong" {
+				t.Errorf("MachineGet() = %q, want pong", data)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "\n", " \t "} {
+		if _, _, err := CACerts(context.Background(), srv.URL, token, true, testOptions()); err == nil {
+			t.Errorf("CACerts() accepted the empty token %q", token)
+		}
+	}
+}
+
+func TestCheckTokenStrength(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		opts    *Options
+		wantErr bool
+	}{
+		{name: "no policy", token: "a"},
+		{name: "long enough", token: "abcdefgh", opts: &Options{MinTokenLength: 8}},
+		{name: "too short", token: "abcdefg", opts: &Options{MinTokenLength: 8}, wantErr: true},
+		// Seven characters but fourteen bytes
+		{name: "multibyte too short", token: "äöüßéèê", opts: &Options{MinTokenLength: 8}, wantErr: true},
+		{name: "multibyte long enough", token: "äöüßéèêë", opts: &Options{MinTokenLength: 8}},
+		{name: "repetitive", token: "aaaaaaaaaaaaaaaa", opts: &Options{MinTokenEntropy: 32}, wantErr: true},
+		{name: "random", token: testToken, opts: &Options{MinTokenEntropy: 128}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTokenStrength(tt.token, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkTokenStrength(%q) error = %v, wantErr %v", tt.token, err, tt.wantErr)
+			}
+		})
+	}
+}
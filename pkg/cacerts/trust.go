@@ -0,0 +1,320 @@
+package cacerts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/sirupsen/logrus"
+)
+
+// Distro selects the trust store layout of the node the CA is installed on.
+type Distro string
+
+const (
+	DistroSUSE   Distro = "suse"
+	DistroDebian Distro = "debian"
+	DistroRHEL   Distro = "rhel"
+
+	// DefaultDistro is used by BuildCAPlan when no distro is given.
+	DefaultDistro = DistroSUSE
+)
+
+// FallbackDistro is used when no distro is given and the distro of the node
+// can't be detected, see DetectTrustStore.
+var FallbackDistro = DefaultDistro
+
+var (
+	osReleasePath = "/etc/os-release"
+
+	// distroIDs maps the ID and ID_LIKE values of os-release to a trust store
+	// layout.
+	distroIDs = map[string]Distro{
+		"suse":                DistroSUSE,
+		"sles":                DistroSUSE,
+		"sle-micro":           DistroSUSE,
+		"opensuse":            DistroSUSE,
+		"opensuse-leap":       DistroSUSE,
+		"opensuse-tumbleweed": DistroSUSE,
+		"opensuse-microos":    DistroSUSE,
+		"debian":              DistroDebian,
+		"ubuntu":              DistroDebian,
+		"rhel":                DistroRHEL,
+		"centos":              DistroRHEL,
+		"fedora":              DistroRHEL,
+		"rocky":               DistroRHEL,
+		"almalinux":           DistroRHEL,
+	}
+)
+
+type trustStore struct {
+	anchorPath string
+	command    string
+	args       []string
+}
+
+var trustStores = map[Distro]trustStore{
+	DistroSUSE: {
+		anchorPath: "/etc/pki/trust/anchors/additional-ca.pem",
+		command:    "update-ca-certificates",
+	},
+	DistroDebian: {
+		// update-ca-certificates only picks up files ending in .crt on Debian
+		anchorPath: "/usr/local/share/ca-certificates/additional-ca.crt",
+		command:    "update-ca-certificates",
+	},
+	DistroRHEL: {
+		anchorPath: "/etc/pki/ca-trust/source/anchors/additional-ca.pem",
+		command:    "update-ca-trust",
+		args:       []string{"extract"},
+	},
+}
+
+// getTrustStore returns the trust store of distro, or of the node if distro is
+// empty.
+func getTrustStore(distro Distro) (trustStore, error) {
+	if distro == "" {
+		distro = detectDistroOrFallback()
+	}
+	store, ok := trustStores[distro]
+	if !ok {
+		return trustStore{}, fmt.Errorf("unsupported distro %q", distro)
+	}
+	return store, nil
+}
+
+func (t trustStore) toFile(cacert []byte) *applyinator.File {
+	return newFile(t.anchorPath, cacert)
+}
+
+func (t trustStore) toInstruction() *applyinator.Instruction {
+	return &applyinator.Instruction{
+		Name:       "update-ca-certificates",
+		SaveOutput: true,
+		Command:    t.command,
+		Args:       t.args,
+	}
+}
+
+// ToUpdateCACertificatesInstruction returns the instruction that refreshes the
+// trust store of distro after a trust anchor was written, update-ca-certificates
+// on SUSE and Debian and update-ca-trust extract on RHEL. An empty distro means
+// the one of the local node, see DetectTrustStore.
+func ToUpdateCACertificatesInstruction(distro Distro) (*applyinator.Instruction, error) {
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, err
+	}
+	return store.toInstruction(), nil
+}
+
+// ToRemoveInstruction returns the instruction that deletes the trust anchor of
+// distro written by ToFile and refreshes the trust store, so the CA of a
+// previous registration is no longer trusted. It succeeds if the anchor is
+// already gone.
+func ToRemoveInstruction(distro Distro) (*applyinator.Instruction, error) {
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, err
+	}
+
+	script := fmt.Sprintf("rm -f '%s' && %s", GetFileDefaults().prefixPath(store.anchorPath),
+		strings.Join(append([]string{store.command}, store.args...), " "))
+	return &applyinator.Instruction{
+		Name:       "remove-ca-certificates",
+		SaveOutput: true,
+		Command:    "sh",
+		Args:       []string{"-c", script},
+	}, nil
+}
+
+// BuildCAPlan returns the files and instructions that install caPEM as a trust
+// anchor on the given distro, without contacting any server. The result can be
+// committed and applied later by an external pipeline.
+func BuildCAPlan(caPEM []byte, distro string) ([]*applyinator.File, []*applyinator.Instruction, error) {
+	if len(caPEM) == 0 {
+		return nil, nil, fmt.Errorf("no CA certs provided")
+	}
+	if err := checkBundleLimits(caPEM, nil); err != nil {
+		return nil, nil, err
+	}
+
+	// The plan may be applied anywhere, so the local node says nothing about
+	// its distro
+	if distro == "" {
+		distro = string(DefaultDistro)
+	}
+	store, err := getTrustStore(Distro(distro))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []*applyinator.File{store.toFile(caPEM)}, []*applyinator.Instruction{store.toInstruction()}, nil
+}
+
+// DetectDistro reads /etc/os-release and returns the trust store layout of the
+// node. The ID is used if it is known, otherwise ID_LIKE must point to exactly
+// one layout, anything else is an error rather than a guess.
+func DetectDistro() (Distro, error) {
+	data, err := ioutil.ReadFile(osReleasePath)
+	if err != nil {
+		return "", fmt.Errorf("detecting distro: %w", err)
+	}
+
+	id, idLike := parseOSRelease(data)
+	if distro, ok := distroIDs[id]; ok {
+		return distro, nil
+	}
+
+	var found []Distro
+	for _, like := range strings.Fields(idLike) {
+		distro, ok := distroIDs[like]
+		if !ok {
+			continue
+		}
+		if len(found) == 0 || found[0] != distro {
+			found = append(found, distro)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("unrecognized distro ID=%q ID_LIKE=%q in %s", id, idLike, osReleasePath)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("ambiguous distro ID=%q ID_LIKE=%q in %s matches %v", id, idLike, osReleasePath, found)
+}
+
+// DetectTrustStore returns the trust anchor path and the trust store update
+// command of the node, as detected by DetectDistro. A node whose distro can't
+// be detected gets the layout of FallbackDistro, with a warning.
+func DetectTrustStore() (path string, updateCmd string, err error) {
+	store, err := getTrustStore(detectDistroOrFallback())
+	if err != nil {
+		return "", "", err
+	}
+	return GetFileDefaults().prefixPath(store.anchorPath), strings.Join(append([]string{store.command}, store.args...), " "), nil
+}
+
+func detectDistroOrFallback() Distro {
+	distro, err := DetectDistro()
+	if err != nil {
+		logrus.Warnf("Using the %s trust store layout: %v", FallbackDistro, err)
+		return FallbackDistro
+	}
+	return distro
+}
+
+func parseOSRelease(data []byte) (id, idLike string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.ToLower(strings.Trim(value, `"'`))
+		switch key {
+		case "ID":
+			id = value
+		case "ID_LIKE":
+			idLike = value
+		}
+	}
+	return
+}
+
+// ToFile downloads the cluster CA of server and returns it as the trust anchor
+// file of distro, in the directory its update command reads, see
+// ToUpdateCACertificatesInstruction. An empty distro means the one of the
+// local node. The file is nil if the server is already trusted or serves no
+// CA, see CACertsResult to tell both apart.
+func ToFile(ctx context.Context, server, token string, distro Distro, opts *Options) (*applyinator.File, error) {
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, err
+	}
+
+	cacert, _, err := CACerts(ctx, server, token, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(cacert) == 0 {
+		return nil, nil
+	}
+	return opts.anchorFile(store, cacert)
+}
+
+// ToTrustPlan downloads the cluster CA of server and returns the trust anchor
+// file for distro followed by the instruction that refreshes its trust store,
+// see BuildCAPlan. The CA is checked against CAFingerprint of opts, if set,
+// before anything is emitted. Both are empty if the server is already
+// trusted. An empty distro means the one of the local node. With the
+// AnchorPath of opts the instruction is left out unless UpdateTrustStore is
+// set.
+func ToTrustPlan(ctx context.Context, server, token string, distro Distro, opts *Options) ([]*applyinator.File, []*applyinator.Instruction, error) {
+	if distro == "" {
+		distro = detectDistroOrFallback()
+	}
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacert, _, err := CACerts(ctx, server, token, true, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cacert) == 0 {
+		return nil, nil, nil
+	}
+
+	file, err := opts.anchorFile(store, cacert)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts != nil && opts.AnchorPath != "" && !opts.UpdateTrustStore {
+		return []*applyinator.File{file}, nil, nil
+	}
+	return []*applyinator.File{file}, []*applyinator.Instruction{store.toInstruction()}, nil
+}
+
+// DetectedFile is a trust anchor file along with how its location was chosen.
+type DetectedFile struct {
+	// File is nil if the server is already trusted and no CA has to be written.
+	File   *applyinator.File
+	Distro Distro
+	Path   string
+}
+
+// ToDetectedFile downloads the cluster CA of server and returns it as a trust
+// anchor for the distro detected on this node.
+func ToDetectedFile(ctx context.Context, server, token string, opts *Options) (*DetectedFile, error) {
+	distro, err := DetectDistro()
+	if err != nil {
+		return nil, err
+	}
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ToFile(ctx, server, token, distro, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	path := GetFileDefaults().prefixPath(store.anchorPath)
+	if opts != nil && opts.AnchorPath != "" {
+		path = opts.AnchorPath
+	}
+	return &DetectedFile{
+		File:   file,
+		Distro: distro,
+		Path:   path,
+	}, nil
+}
@@ -0,0 +1,210 @@
+package cacerts
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestToUpdateCACertificatesInstruction(t *testing.T) {
+	tests := []struct {
+		distro      Distro
+		wantCommand string
+		wantArgs    []string
+		wantErr     bool
+	}{
+		{
+			distro:      DistroDebian,
+			wantCommand: "update-ca-certificates",
+		},
+		{
+			distro:      DistroSUSE,
+			wantCommand: "update-ca-certificates",
+		},
+		{
+			distro:      DistroRHEL,
+			wantCommand: "update-ca-trust",
+			wantArgs:    []string{"extract"},
+		},
+		{
+			distro:  "arch",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.distro), func(t *testing.T) {
+			instruction, err := ToUpdateCACertificatesInstruction(tt.distro)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToUpdateCACertificatesInstruction(%q) error = %v, wantErr %v", tt.distro, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if instruction.Command != tt.wantCommand || !reflect.DeepEqual(instruction.Args, tt.wantArgs) {
+				t.Errorf("ToUpdateCACertificatesInstruction(%q) runs %s %v, want %s %v",
+					tt.distro, instruction.Command, instruction.Args, tt.wantCommand, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	data := []byte(`# a comment
+NAME="openSUSE Leap"
+  ID='opensuse-leap'
+ID_LIKE="SUSE openSUSE"
+VERSION_ID=
+`)
+	id, idLike := parseOSRelease(data)
+	if id != "opensuse-leap" || idLike != "suse opensuse" {
+		t.Errorf("parseOSRelease() = %q, %q, want opensuse-leap, suse opensuse", id, idLike)
+	}
+}
+
+// withOSRelease points DetectDistro at the os-release fixture name for the
+// rest of the test.
+func withOSRelease(t *testing.T, name string) {
+	old := osReleasePath
+	osReleasePath = filepath.Join("testdata", "os-release", name)
+	t.Cleanup(func() {
+		osReleasePath = old
+	})
+}
+
+func TestDetectDistro(t *testing.T) {
+	tests := []struct {
+		osRelease string
+		want      Distro
+		wantErr   bool
+	}{
+		{osRelease: "ubuntu", want: DistroDebian},
+		{osRelease: "linuxmint", want: DistroDebian},
+		{osRelease: "rocky", want: DistroRHEL},
+		{osRelease: "oracle", want: DistroRHEL},
+		{osRelease: "sle-micro", want: DistroSUSE},
+		{osRelease: "arch", wantErr: true},
+		{osRelease: "ambiguous", wantErr: true},
+		{osRelease: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.osRelease, func(t *testing.T) {
+			withOSRelease(t, tt.osRelease)
+			got, err := DetectDistro()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetectDistro() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DetectDistro() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectTrustStore(t *testing.T) {
+	tests := []struct {
+		osRelease     string
+		wantPath      string
+		wantUpdateCmd string
+	}{
+		{
+			osRelease:     "ubuntu",
+			wantPath:      "/usr/local/share/ca-certificates/additional-ca.crt",
+			wantUpdateCmd: "update-ca-certificates",
+		},
+		{
+			osRelease:     "rocky",
+			wantPath:      "/etc/pki/ca-trust/source/anchors/additional-ca.pem",
+			wantUpdateCmd: "update-ca-trust extract",
+		},
+		{
+			// An unknown distro gets the layout of FallbackDistro
+			osRelease:     "arch",
+			wantPath:      "/etc/pki/trust/anchors/additional-ca.pem",
+			wantUpdateCmd: "update-ca-certificates",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.osRelease, func(t *testing.T) {
+			withOSRelease(t, tt.osRelease)
+			path, updateCmd, err := DetectTrustStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.wantPath || updateCmd != tt.wantUpdateCmd {
+				t.Errorf("DetectTrustStore() = %s, %s, want %s, %s", path, updateCmd, tt.wantPath, tt.wantUpdateCmd)
+			}
+		})
+	}
+}
+
+func TestToFileAlreadyTrusted(t *testing.T) {
+	// A server with a publicly trusted certificate, see TestMain, and one
+	// that verifiably serves no CA
+	public := newTestServer(t, testSystemRoot, http.NotFoundHandler())
+	noCA := newCACertsServer(t, testToken, []byte{}, nil)
+
+	for name, server := range map[string]string{
+		"publicly trusted": public.URL,
+		"no CA":            noCA.URL,
+	} {
+		t.Run(name, func(t *testing.T) {
+			file, err := ToFile(context.Background(), server, testToken, DistroSUSE, testOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file != nil {
+				t.Errorf("ToFile() = %+v, want no file", file)
+			}
+
+			files, instructions, err := ToTrustPlan(context.Background(), server, testToken, DistroSUSE, testOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 0 || len(instructions) != 0 {
+				t.Errorf("ToTrustPlan() = %d files and %d instructions, want none", len(files), len(instructions))
+			}
+		})
+	}
+}
+
+func TestAnchorBundleLimits(t *testing.T) {
+	// Two CAs, one more than MaxBundleCerts allows
+	bundle := append(append([]byte{}, newTestCA(t, "rancher CA").pem...), newTestCA(t, "next rancher CA").pem...)
+	srv := newCACertsServer(t, testToken, bundle, nil)
+	newOptions := func() *Options {
+		opts := testOptions()
+		opts.MaxBundleCerts = 1
+		return opts
+	}
+
+	for name, emit := range map[string]func() error{
+		"ToFile": func() error {
+			_, err := ToFile(context.Background(), srv.URL, testToken, DistroSUSE, newOptions())
+			return err
+		},
+		"ToTrustPlan": func() error {
+			_, _, err := ToTrustPlan(context.Background(), srv.URL, testToken, DistroSUSE, newOptions())
+			return err
+		},
+		"BootstrapTrust": func() error {
+			_, err := BootstrapTrust(context.Background(), BootstrapOptions{
+				Server:  srv.URL,
+				Token:   testToken,
+				Distro:  DistroSUSE,
+				Options: newOptions(),
+			})
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := emit(); err == nil {
+				t.Errorf("%s emitted a bundle over MaxBundleCerts", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package cacerts
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxWatchBackoff bounds how far Watch backs off after failures, as a
+// multiple of its interval.
+const maxWatchBackoff = 8
+
+// Watch downloads the cluster CA of server every interval and calls onChange
+// with it and its checksum on the first successful download and whenever the
+// checksum changes afterwards, so a rotated CA can be installed before the
+// old one is dropped by the server. Every poll goes through the X-Cattle-Hash
+// handshake, the MemoryCache and CacheFile of opts are neither read nor
+// filled, since a cached CA the serving certificate still verifies against
+// would hide a rotated bundle. A server that becomes trusted by the system
+// roots is reported with an empty CA. Failed downloads are logged and
+// the delay doubles up to 8 times interval until one succeeds again. Watch
+// returns the error of ctx once it is done.
+func Watch(ctx context.Context, server, token string, interval time.Duration, onChange func(newPEM []byte, checksum string), opts *Options) error {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	var download Options
+	if opts != nil {
+		download = *opts
+	}
+	download.noMemoryCache = true
+	download.CacheFile = ""
+
+	var (
+		seen         bool
+		lastChecksum string
+		delay        = interval
+	)
+	for {
+		cacert, checksum, err := CACerts(ctx, server, token, true, &download)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			delay *= 2
+			if delay > maxWatchBackoff*interval {
+				delay = maxWatchBackoff * interval
+			}
+			logrus.Warnf("Failed to check cacerts of %s, retrying in %s: %v", server, delay, err)
+		default:
+			delay = interval
+			if !seen || checksum != lastChecksum {
+				seen = true
+				lastChecksum = checksum
+				onChange(cacert, checksum)
+			}
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
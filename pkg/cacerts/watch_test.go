@@ -0,0 +1,66 @@
+package cacerts
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchReportsRotatedBundle(t *testing.T) {
+	// The bundle gains a second CA while the serving certificate, which still
+	// verifies against the first one, stays the same
+	var (
+		lock   sync.Mutex
+		bundle []byte
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		body := bundle
+		lock.Unlock()
+		if nonce := r.Header.Get("X-Cattle-Nonce"); nonce != "" {
+			w.Header().Set("X-Cattle-Hash", ExpectedHash(testToken, nonce, body))
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	first := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	rotated := append(append([]byte{}, first...), newTestCA(t, "next rancher CA").pem...)
+	bundle = first
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan []byte, 2)
+	opts := testOptions()
+	opts.MemoryCache = true
+	opts.CacheFile = filepath.Join(t.TempDir(), "cacerts.pem")
+	done := make(chan error, 1)
+	go func() {
+		done <- Watch(ctx, srv.URL, testToken, 10*time.Millisecond, func(newPEM []byte, checksum string) {
+			changes <- newPEM
+		}, opts)
+	}()
+
+	for i, want := range [][]byte{first, rotated} {
+		select {
+		case got := <-changes:
+			if string(got) != string(want) {
+				t.Fatalf("change %d reported %q, want %q", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("change %d was never reported", i)
+		}
+		lock.Lock()
+		bundle = rotated
+		lock.Unlock()
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Watch() = %v, want %v", err, context.Canceled)
+	}
+}
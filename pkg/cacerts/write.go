@@ -0,0 +1,83 @@
+package cacerts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// WriteCAFile atomically replaces path with cacert. The data is written to a
+// temporary file in the same directory, fsynced, renamed over path and then the
+// directory is fsynced too, so a crash never leaves a truncated trust anchor.
+func WriteCAFile(path string, cacert []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(cacert); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", dir, err)
+	}
+	return nil
+}
+
+// InstallCA writes cacert to the trust anchor of distro and refreshes the trust
+// store on the local node. The bundle must be within the default limits, see
+// DefaultMaxBundleSize and DefaultMaxBundleCerts.
+func InstallCA(cacert []byte, distro Distro) error {
+	store, err := getTrustStore(distro)
+	if err != nil {
+		return err
+	}
+	if err := checkBundleLimits(cacert, nil); err != nil {
+		return err
+	}
+	if err := WriteCAFile(store.anchorPath, cacert); err != nil {
+		return err
+	}
+
+	output, err := exec.Command(store.command, store.args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %s: %s: %w", store.command, output, err)
+	}
+	return nil
+}
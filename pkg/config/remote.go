@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -10,13 +11,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func processRemote(cfg Config) (Config, error) {
+func processRemote(ctx context.Context, cfg Config) (Config, error) {
 	if cfg.Role != "" || cfg.Server == "" || cfg.Token == "" {
 		return cfg, nil
 	}
 
 	logrus.Infof("server and token set but required role is not set. Trying to bootstrapping config from machine inventory")
-	resp, _, err := cacerts.MachineGet(cfg.Server, cfg.Token, "/v1-rancheros/inventory")
+	resp, _, err := cacerts.MachineGet(ctx, cfg.Server, cfg.Token, "/v1-rancheros/inventory", nil)
 	if err != nil {
 		return cfg, fmt.Errorf("from machine inventory: %w", err)
 	}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"io/fs"
 	"io/ioutil"
 	"os"
@@ -85,7 +86,7 @@ func paths() (result []string) {
 	return
 }
 
-func Load(path string) (result Config, err error) {
+func Load(ctx context.Context, path string) (result Config, err error) {
 	var (
 		values = map[string]interface{}{}
 	)
@@ -115,7 +116,7 @@ func Load(path string) (result Config, err error) {
 		return
 	}
 
-	return processRemote(result)
+	return processRemote(ctx, result)
 }
 
 func populatedSystemResources(config *Config) error {
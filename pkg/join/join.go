@@ -1,6 +1,7 @@
 package join
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"strings"
@@ -19,8 +20,8 @@ func GetInstallScriptFile(dataDir string) string {
 	return fmt.Sprintf("%s/install.sh", dataDir)
 }
 
-func ToScriptFile(config *config.Config, dataDir string) (*applyinator.File, error) {
-	data, _, err := cacerts.Get(config.Server, config.Token, "/system-agent-install.sh")
+func ToScriptFile(ctx context.Context, config *config.Config, dataDir string) (*applyinator.File, error) {
+	data, _, err := cacerts.Get(ctx, config.Server, config.Token, "/system-agent-install.sh", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +32,7 @@ func ToScriptFile(config *config.Config, dataDir string) (*applyinator.File, err
 	}, nil
 }
 
-func ToInstruction(config *config.Config, dataDir string) (*applyinator.Instruction, error) {
+func ToInstruction(ctx context.Context, config *config.Config, dataDir string) (*applyinator.Instruction, error) {
 	var (
 		etcd         = roles.IsEtcd(config.Role)
 		controlPlane = roles.IsControlPlane(config.Role)
@@ -42,7 +43,7 @@ func ToInstruction(config *config.Config, dataDir string) (*applyinator.Instruct
 		return nil, fmt.Errorf("invalid role (%s) defined", config.Role)
 	}
 
-	_, caChecksum, err := cacerts.CACerts(config.Server, config.Token, true)
+	_, caChecksum, err := cacerts.CACerts(ctx, config.Server, config.Token, true, nil)
 	if err != nil {
 		return nil, err
 	}
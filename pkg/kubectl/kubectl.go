@@ -3,6 +3,7 @@ package kubectl
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/rancher/rancherd/pkg/config"
 )
@@ -30,15 +31,29 @@ func Command(k8sVersion string) string {
 	return kubectl
 }
 
+// GetKubeconfig returns kubeconfig if set, otherwise the first existing entry
+// of $KUBECONFIG, which like for kubectl may be a list, and finally the first
+// existing k3s, rke2 or ~/.kube/config file.
 func GetKubeconfig(kubeconfig string) (string, error) {
 	if kubeconfig != "" {
 		return kubeconfig, nil
 	}
 
-	for _, kubeconfig := range kubeconfigs {
+	candidates := filepath.SplitList(os.Getenv("KUBECONFIG"))
+	candidates = append(candidates, kubeconfigs...)
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".kube", "config"))
+	}
+
+	var tried []string
+	for _, kubeconfig := range candidates {
+		if kubeconfig == "" {
+			continue
+		}
 		if _, err := os.Stat(kubeconfig); err == nil {
 			return kubeconfig, nil
 		}
+		tried = append(tried, kubeconfig)
 	}
-	return "", fmt.Errorf("failed to find kubeconfig file at %v", kubeconfigs)
+	return "", fmt.Errorf("failed to find kubeconfig file at %v", tried)
 }
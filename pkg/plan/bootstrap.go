@@ -41,7 +41,7 @@ func toInitPlan(config *config.Config, dataDir string) (*applyinator.Plan, error
 	return (*applyinator.Plan)(&plan), nil
 }
 
-func toJoinPlan(cfg *config.Config, dataDir string) (*applyinator.Plan, error) {
+func toJoinPlan(ctx context.Context, cfg *config.Config, dataDir string) (*applyinator.Plan, error) {
 	if cfg.Server == "" {
 		return nil, fmt.Errorf("server is required in config for all roles besides cluster-init")
 	}
@@ -50,10 +50,10 @@ func toJoinPlan(cfg *config.Config, dataDir string) (*applyinator.Plan, error) {
 	}
 
 	plan := plan{}
-	if err := plan.addFile(join.ToScriptFile(cfg, dataDir)); err != nil {
+	if err := plan.addFile(join.ToScriptFile(ctx, cfg, dataDir)); err != nil {
 		return nil, err
 	}
-	if err := plan.addInstruction(join.ToInstruction(cfg, dataDir)); err != nil {
+	if err := plan.addInstruction(join.ToInstruction(ctx, cfg, dataDir)); err != nil {
 		return nil, err
 	}
 	if err := plan.addInstruction(probe.ToInstruction()); err != nil {
@@ -74,7 +74,7 @@ func ToPlan(ctx context.Context, config *config.Config, dataDir string) (*applyi
 	if newCfg.Role == "cluster-init" {
 		return toInitPlan(&newCfg, dataDir)
 	}
-	return toJoinPlan(&newCfg, dataDir)
+	return toJoinPlan(ctx, &newCfg, dataDir)
 }
 
 func (p *plan) addInstructions(cfg *config.Config, dataDir string) error {
@@ -2,15 +2,28 @@ package rancher
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	corev1api "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 
+	"github.com/rancher/rancherd/pkg/cacerts"
 	"github.com/rancher/rancherd/pkg/kubectl"
 )
 
@@ -19,13 +32,165 @@ const (
 	rancherSettingInternalCACerts   = "internal-cacerts"
 	clusterClientSecret             = "local-kubeconfig"
 	clusterNamespace                = "fleet-local"
+	clusterServerURLKey             = "apiServerURL"
+	clusterCAKey                    = "apiServerCA"
+
+	// DefaultSettingsTimeout is how long to wait for the settings to be set.
+	DefaultSettingsTimeout = 2 * time.Minute
+	// DefaultSettingsInterval is how often the settings are checked.
+	DefaultSettingsInterval = 5 * time.Second
+	// DefaultRequestTimeout is the timeout of each API call.
+	DefaultRequestTimeout = 30 * time.Second
+	// DefaultSecretTimeout is how long to wait for the client secret to be
+	// created.
+	DefaultSecretTimeout = time.Minute
 )
 
 type Options struct {
 	Kubeconfig string
+	// RESTConfig is used instead of loading Kubeconfig, for callers that
+	// already have one.
+	RESTConfig *rest.Config
+	// Kubernetes and Dynamic are used instead of clients built from the
+	// RESTConfig or Kubeconfig, for instance fakes in tests. The discovery of
+	// the settings CRD goes through Kubernetes.
+	Kubernetes kubernetes.Interface
+	Dynamic    dynamic.Interface
+	// DisableCACertsNormalization writes the internal-cacerts setting into the
+	// secret verbatim instead of stripping CRs and adding a trailing newline.
+	DisableCACertsNormalization bool
+	// AllowInsecureServerURL skips checking that internal-server-url is an
+	// https URL with a host before writing it into the secret.
+	AllowInsecureServerURL bool
+
+	// SecretNamespace and SecretName locate the cluster client secret,
+	// fleet-local/local-kubeconfig by default.
+	SecretNamespace string
+	SecretName      string
+	// ServerURLKey and CAKey are the secret keys the internal-server-url and
+	// internal-cacerts settings are written to, apiServerURL and apiServerCA
+	// by default.
+	ServerURLKey string
+	CAKey        string
+	// ServerURLSetting and CACertsSetting are the Rancher settings read into
+	// the secret, internal-server-url and internal-cacerts by default.
+	ServerURLSetting string
+	CACertsSetting   string
+	// ServerURLFallbackSetting, if set, is read when ServerURLSetting doesn't
+	// exist, for instance internal-api-url on Rancher versions using that
+	// name.
+	ServerURLFallbackSetting string
+
+	// DisableEvents stops UpdateClientSecret and ResetClientSecret from
+	// recording a ClientSecretUpdated or ClientSecretReset event on the secret
+	// when they change it.
+	DisableEvents bool
+	// DryRun logs the changes that would be made to the secret instead of
+	// updating it.
+	DryRun bool
+
+	// RequestTimeout bounds each call to the API server, so an unreachable
+	// server fails instead of hanging. Defaults to DefaultRequestTimeout.
+	RequestTimeout time.Duration
+	// Logger receives the progress of UpdateClientSecret, the logrus standard
+	// logger if nil.
+	Logger *logrus.Logger
+
+	// SettingsTimeout is how long to wait for Rancher to serve its settings
+	// CRD and fill in the internal-server-url and internal-cacerts settings,
+	// which are empty for a while after it starts. Defaults to
+	// DefaultSettingsTimeout.
+	SettingsTimeout time.Duration
+	// SettingsInterval is how often the settings are checked while waiting.
+	// Defaults to DefaultSettingsInterval.
+	SettingsInterval time.Duration
+	// SecretTimeout is how long UpdateClientSecret waits for the client secret
+	// to be created, since fleet creates it some time after the fleet-local
+	// namespace. It is checked every SettingsInterval. Defaults to
+	// DefaultSecretTimeout.
+	SecretTimeout time.Duration
+}
+
+func (o *Options) logger() *logrus.Logger {
+	if o.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return o.Logger
+}
+
+// requestContext returns the context of a single API call.
+func (o *Options) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := o.RequestTimeout
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (o *Options) settingsTimeout() time.Duration {
+	if o.SettingsTimeout <= 0 {
+		return DefaultSettingsTimeout
+	}
+	return o.SettingsTimeout
+}
+
+func (o *Options) settingsInterval() time.Duration {
+	if o.SettingsInterval <= 0 {
+		return DefaultSettingsInterval
+	}
+	return o.SettingsInterval
+}
+
+func (o *Options) serverURLSetting() string {
+	if o.ServerURLSetting == "" {
+		return rancherSettingInternalServerURL
+	}
+	return o.ServerURLSetting
+}
+
+func (o *Options) caCertsSetting() string {
+	if o.CACertsSetting == "" {
+		return rancherSettingInternalCACerts
+	}
+	return o.CACertsSetting
+}
+
+func (o *Options) secretTimeout() time.Duration {
+	if o.SecretTimeout <= 0 {
+		return DefaultSecretTimeout
+	}
+	return o.SecretTimeout
+}
+
+func (o *Options) secretNamespace() string {
+	if o.SecretNamespace == "" {
+		return clusterNamespace
+	}
+	return o.SecretNamespace
+}
+
+func (o *Options) secretName() string {
+	if o.SecretName == "" {
+		return clusterClientSecret
+	}
+	return o.SecretName
+}
+
+func (o *Options) serverURLKey() string {
+	if o.ServerURLKey == "" {
+		return clusterServerURLKey
+	}
+	return o.ServerURLKey
+}
+
+func (o *Options) caKey() string {
+	if o.CAKey == "" {
+		return clusterCAKey
+	}
+	return o.CAKey
 }
 
-// Update cluster client secret (fleet-local/local-kubeconfig):
+// Update cluster client secret (fleet-local/local-kubeconfig unless set in opts):
 // apiServerURL: value of Rancher setting "internal-server-url"
 // apiServerCA: value of Rancher setting "internal-cacerts"
 // Fleet needs these values to be set after Rancher v2.7.5 to provision a local cluster
@@ -34,59 +199,477 @@ func UpdateClientSecret(ctx context.Context, opts *Options) error {
 		opts = &Options{}
 	}
 
-	kubeconfig, err := kubectl.GetKubeconfig(opts.Kubeconfig)
+	k8s, client, err := opts.clients()
 	if err != nil {
 		return err
 	}
 
-	conf, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	internalServerURL, internalCACerts, err := clientSecretValues(ctx, k8s, client, opts)
 	if err != nil {
 		return err
 	}
 
-	client := dynamic.NewForConfigOrDie(conf)
-	settingClient := client.Resource(schema.GroupVersionResource{
-		Group:    "management.cattle.io",
-		Version:  "v3",
-		Resource: "settings",
-	})
+	if err := waitForSecret(ctx, k8s.CoreV1(), opts.secretNamespace(), opts.secretName(), opts); err != nil {
+		return err
+	}
+
+	_, err = updateSecret(ctx, k8s.CoreV1(), opts.secretNamespace(), opts.secretName(), internalServerURL, internalCACerts, opts)
+	return err
+}
 
-	internalServerURLSetting, err := settingClient.Get(ctx, rancherSettingInternalServerURL, v1.GetOptions{})
+// UpdateSummary counts the secrets handled by UpdateClientSecrets.
+type UpdateSummary struct {
+	Updated  int
+	UpToDate int
+	Failed   int
+}
+
+// UpdateClientSecrets is UpdateClientSecret for every secret in any namespace
+// matching labelSelector, for setups with more than one fleet cluster. The
+// SecretNamespace and SecretName of opts are ignored. labelSelector is
+// required, an empty one would match every secret of the cluster. A failing
+// secret doesn't stop the others, all errors are returned together.
+func UpdateClientSecrets(ctx context.Context, opts *Options, labelSelector string) (*UpdateSummary, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if strings.TrimSpace(labelSelector) == "" {
+		return nil, fmt.Errorf("a label selector is required to update cluster client secrets")
+	}
+
+	k8s, client, err := opts.clients()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	internalServerURL := internalServerURLSetting.Object["value"].(string)
-	logrus.Infof("Rancher setting %s is %q", rancherSettingInternalServerURL, internalServerURL)
 
-	internalCACertSetting, err := settingClient.Get(ctx, rancherSettingInternalCACerts, v1.GetOptions{})
+	internalServerURL, internalCACerts, err := clientSecretValues(ctx, k8s, client, opts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	listCtx, cancel := opts.requestContext(ctx)
+	defer cancel()
+	secrets, err := k8s.CoreV1().Secrets(v1.NamespaceAll).List(listCtx, v1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, err
 	}
-	internalCACerts := internalCACertSetting.Object["value"].(string)
-	logrus.Infof("Rancher setting %s is %q", rancherSettingInternalCACerts, internalCACerts)
 
-	if internalServerURL == "" || internalCACerts == "" {
-		return fmt.Errorf("both %s and %s settings must be configured", rancherSettingInternalCACerts, rancherSettingInternalCACerts)
+	var names []string
+	for _, secret := range secrets.Items {
+		names = append(names, secret.Namespace+"/"+secret.Name)
 	}
+	opts.logger().Infof("Label selector %q matches %d cluster client secrets: %s", labelSelector, len(names), strings.Join(names, ", "))
 
-	k8s, err := kubernetes.NewForConfig(conf)
+	summary := &UpdateSummary{}
+	var errs []error
+	for _, secret := range secrets.Items {
+		upToDate, err := updateSecret(ctx, k8s.CoreV1(), secret.Namespace, secret.Name, internalServerURL, internalCACerts, opts)
+		switch {
+		case err != nil:
+			summary.Failed++
+			errs = append(errs, fmt.Errorf("secret %s/%s: %w", secret.Namespace, secret.Name, err))
+		case upToDate:
+			summary.UpToDate++
+		default:
+			summary.Updated++
+		}
+	}
+
+	opts.logger().Infof("Cluster client secrets: %d updated, %d up to date, %d failed", summary.Updated, summary.UpToDate, summary.Failed)
+	return summary, utilerrors.NewAggregate(errs)
+}
+
+// clientSecretValues waits for the settings that go in the client secret and
+// checks them. The wait for the CRD and for the values share the
+// SettingsTimeout.
+func clientSecretValues(ctx context.Context, k8s kubernetes.Interface, client dynamic.Interface, opts *Options) (string, string, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, opts.settingsTimeout())
+	defer cancel()
+
+	if err := waitForSettingsCRD(waitCtx, k8s.Discovery(), opts.settingsInterval(), opts.logger()); err != nil {
+		return "", "", err
+	}
+
+	serverURLSetting, err := resolveServerURLSetting(ctx, client, opts)
+	if err != nil {
+		return "", "", err
+	}
+	caCertsSetting := opts.caCertsSetting()
+
+	internalServerURL, internalCACerts, err := waitForSettings(waitCtx, client, serverURLSetting, caCertsSetting, opts)
 	if err != nil {
+		return "", "", err
+	}
+	log := opts.logger()
+	log.Infof("Using Rancher settings %s and %s", serverURLSetting, caCertsSetting)
+	log.Debugf("Rancher setting %s is %q", serverURLSetting, internalServerURL)
+	log.Debugf("Rancher setting %s has %d bytes with checksum %s", caCertsSetting, len(internalCACerts), checksum([]byte(internalCACerts)))
+
+	if !opts.AllowInsecureServerURL {
+		if err := validateServerURL(internalServerURL); err != nil {
+			return "", "", fmt.Errorf("invalid %s setting: %w", serverURLSetting, err)
+		}
+	}
+
+	if !opts.DisableCACertsNormalization {
+		internalCACerts, err = normalizeCACerts(internalCACerts)
+		if err != nil {
+			return "", "", fmt.Errorf("normalizing %s setting: %w", caCertsSetting, err)
+		}
+	}
+	if err := validateCACerts(internalCACerts); err != nil {
+		return "", "", fmt.Errorf("invalid %s setting: %w", caCertsSetting, err)
+	}
+	return internalServerURL, internalCACerts, nil
+}
+
+// updateSecret writes the server URL and CA into the secret namespace/name,
+// returning whether it already had them.
+func updateSecret(ctx context.Context, core corev1.CoreV1Interface, namespace, name, internalServerURL, internalCACerts string, opts *Options) (bool, error) {
+	log := opts.logger()
+	secrets := core.Secrets(namespace)
+
+	// Rancher controllers may update the secret concurrently, so a conflict
+	// re-reads it and applies the values again
+	var updated *corev1api.Secret
+	upToDate := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		getCtx, cancel := opts.requestContext(ctx)
+		defer cancel()
+		secret, err := secrets.Get(getCtx, name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		// Skip the write if nothing changed, it would only trigger fleet
+		// reconciles
+		upToDate = string(secret.Data[opts.serverURLKey()]) == internalServerURL &&
+			string(secret.Data[opts.caKey()]) == internalCACerts
+		if upToDate {
+			return nil
+		}
+
+		toUpdate := secret.DeepCopy()
+		if toUpdate.Data == nil {
+			toUpdate.Data = map[string][]byte{}
+		}
+		toUpdate.Data[opts.serverURLKey()] = []byte(internalServerURL)
+		toUpdate.Data[opts.caKey()] = []byte(internalCACerts)
+
+		if opts.DryRun {
+			logSecretDiff(log, secret.Data, toUpdate.Data, opts.serverURLKey(), opts.caKey())
+			return nil
+		}
+		updateCtx, cancel := opts.requestContext(ctx)
+		defer cancel()
+		updated, err = secrets.Update(updateCtx, toUpdate, v1.UpdateOptions{})
 		return err
+	})
+
+	switch {
+	case err != nil:
+		return false, err
+	case upToDate:
+		log.Infof("Cluster client secret %s/%s is already up to date", namespace, name)
+	case opts.DryRun:
+		log.Infof("Cluster client secret %s/%s would be updated", namespace, name)
+	default:
+		log.Infof("Cluster client secret %s/%s is updated", namespace, name)
+		if !opts.DisableEvents {
+			recordEvent(ctx, core, updated, "ClientSecretUpdated",
+				fmt.Sprintf("Set %s to %s and updated %s", opts.serverURLKey(), internalServerURL, opts.caKey()), opts)
+		}
 	}
+	return upToDate, nil
+}
 
-	secret, err := k8s.CoreV1().Secrets(clusterNamespace).Get(ctx, clusterClientSecret, v1.GetOptions{})
+// ResetClientSecret removes the server URL and CA from the cluster client
+// secret, the inverse of UpdateClientSecret, so fleet stops using a previous
+// Rancher until UpdateClientSecret fills them in from the new settings. It
+// does nothing if the keys or the secret are already gone.
+func ResetClientSecret(ctx context.Context, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	k8s, _, err := opts.clients()
 	if err != nil {
 		return err
 	}
 
-	toUpdate := secret.DeepCopy()
-	toUpdate.Data["apiServerURL"] = []byte(internalServerURL)
-	toUpdate.Data["apiServerCA"] = []byte(internalCACerts)
-	_, err = k8s.CoreV1().Secrets(clusterNamespace).Update(ctx, toUpdate, v1.UpdateOptions{})
+	return resetSecret(ctx, k8s.CoreV1(), opts.secretNamespace(), opts.secretName(), opts)
+}
+
+func resetSecret(ctx context.Context, core corev1.CoreV1Interface, namespace, name string, opts *Options) error {
+	log := opts.logger()
+	secrets := core.Secrets(namespace)
+
+	var updated *corev1api.Secret
+	alreadyReset := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		getCtx, cancel := opts.requestContext(ctx)
+		defer cancel()
+		secret, err := secrets.Get(getCtx, name, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			alreadyReset = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		_, hasURL := secret.Data[opts.serverURLKey()]
+		_, hasCA := secret.Data[opts.caKey()]
+		alreadyReset = !hasURL && !hasCA
+		if alreadyReset {
+			return nil
+		}
+
+		toUpdate := secret.DeepCopy()
+		delete(toUpdate.Data, opts.serverURLKey())
+		delete(toUpdate.Data, opts.caKey())
+
+		if opts.DryRun {
+			logSecretDiff(log, secret.Data, toUpdate.Data, opts.serverURLKey(), opts.caKey())
+			return nil
+		}
+		updateCtx, cancel := opts.requestContext(ctx)
+		defer cancel()
+		updated, err = secrets.Update(updateCtx, toUpdate, v1.UpdateOptions{})
+		return err
+	})
+
+	switch {
+	case err != nil:
+		return err
+	case alreadyReset:
+		log.Infof("Cluster client secret %s/%s has no server URL or CA to reset", namespace, name)
+	case opts.DryRun:
+		log.Infof("Cluster client secret %s/%s would be reset", namespace, name)
+	default:
+		log.Infof("Cluster client secret %s/%s is reset", namespace, name)
+		if !opts.DisableEvents {
+			recordEvent(ctx, core, updated, "ClientSecretReset",
+				fmt.Sprintf("Removed %s and %s", opts.serverURLKey(), opts.caKey()), opts)
+		}
+	}
+	return nil
+}
+
+// recordEvent leaves an event on secret for auditing. It is best effort, a
+// failure is only logged.
+func recordEvent(ctx context.Context, core corev1.CoreV1Interface, secret *corev1api.Secret, reason, message string, opts *Options) {
+	now := v1.Now()
+	event := &corev1api.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", secret.Name, now.UnixNano()),
+			Namespace: secret.Namespace,
+		},
+		InvolvedObject: corev1api.ObjectReference{
+			APIVersion:      "v1",
+			Kind:            "Secret",
+			Namespace:       secret.Namespace,
+			Name:            secret.Name,
+			UID:             secret.UID,
+			ResourceVersion: secret.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1api.EventTypeNormal,
+		Source:         corev1api.EventSource{Component: "rancherd"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	ctx, cancel := opts.requestContext(ctx)
+	defer cancel()
+	if _, err := core.Events(secret.Namespace).Create(ctx, event, v1.CreateOptions{}); err != nil {
+		opts.logger().Warnf("Failed to record event for secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+}
 
-	if err == nil {
-		fmt.Println("Cluster client secret is updated.")
+func logSecretDiff(log *logrus.Logger, current, updated map[string][]byte, keys ...string) {
+	for _, key := range keys {
+		if string(current[key]) == string(updated[key]) {
+			log.Infof("Secret key %s is unchanged", key)
+			continue
+		}
+		log.Infof("Secret key %s would change from checksum %s to %s", key, checksum(current[key]), checksum(updated[key]))
+		log.Debugf("Secret key %s would change from %q to %q", key, current[key], updated[key])
 	}
+}
 
+// checksum identifies a value in logs without printing it.
+func checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// clients returns the Kubernetes and Dynamic clients of opts, building the
+// missing ones from restConfig.
+func (o *Options) clients() (kubernetes.Interface, dynamic.Interface, error) {
+	k8s, client := o.Kubernetes, o.Dynamic
+	if k8s != nil && client != nil {
+		return k8s, client, nil
+	}
+
+	conf, err := restConfig(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k8s == nil {
+		if k8s, err = kubernetes.NewForConfig(conf); err != nil {
+			return nil, nil, err
+		}
+	}
+	if client == nil {
+		if client, err = dynamic.NewForConfig(conf); err != nil {
+			return nil, nil, err
+		}
+	}
+	return k8s, client, nil
+}
+
+// restConfig returns the RESTConfig of opts if set, otherwise it loads the
+// kubeconfig of opts, or the one found on the node, and
+// falls back to the in-cluster config when none was given or found, so it
+// also works from a pod.
+func restConfig(opts *Options) (*rest.Config, error) {
+	if opts.RESTConfig != nil {
+		return opts.RESTConfig, nil
+	}
+	kubeconfig, err := kubectl.GetKubeconfig(opts.Kubeconfig)
+	if err != nil {
+		if opts.Kubeconfig != "" || os.Getenv("KUBECONFIG") != "" {
+			return nil, err
+		}
+		conf, inClusterErr := rest.InClusterConfig()
+		if inClusterErr != nil {
+			return nil, fmt.Errorf("%v, and no in-cluster config: %w", err, inClusterErr)
+		}
+		return conf, nil
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// waitForSecret polls the secret namespace/name until it exists. Any error
+// other than NotFound is returned right away.
+func waitForSecret(ctx context.Context, core corev1.CoreV1Interface, namespace, name string, opts *Options) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.secretTimeout())
+	defer cancel()
+
+	for {
+		getCtx, cancelGet := opts.requestContext(ctx)
+		_, err := core.Secrets(namespace).Get(getCtx, name, v1.GetOptions{})
+		cancelGet()
+		if err == nil {
+			return nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		opts.logger().Debugf("Waiting for cluster client secret %s/%s to be created", namespace, name)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for cluster client secret %s/%s to be created: %w", namespace, name, err)
+		case <-time.After(opts.settingsInterval()):
+		}
+	}
+}
+
+// resolveServerURLSetting returns ServerURLSetting, or ServerURLFallbackSetting
+// if the first doesn't exist.
+func resolveServerURLSetting(ctx context.Context, client dynamic.Interface, opts *Options) (string, error) {
+	name := opts.serverURLSetting()
+	if opts.ServerURLFallbackSetting == "" {
+		return name, nil
+	}
+
+	_, err := getSettingWithTimeout(ctx, client, name, opts)
+	switch {
+	case err == nil:
+		return name, nil
+	case apierrors.IsNotFound(err):
+		opts.logger().Infof("Rancher setting %s does not exist, using %s", name, opts.ServerURLFallbackSetting)
+		return opts.ServerURLFallbackSetting, nil
+	}
+	return "", err
+}
+
+// waitForSettings polls the server URL and CA settings until both have a
+// value or ctx is done.
+func waitForSettings(ctx context.Context, client dynamic.Interface, serverURLSetting, caCertsSetting string, opts *Options) (string, string, error) {
+	for {
+		internalServerURL, err := getSettingWithTimeout(ctx, client, serverURLSetting, opts)
+		if err != nil {
+			return "", "", err
+		}
+		internalCACerts, err := getSettingWithTimeout(ctx, client, caCertsSetting, opts)
+		if err != nil {
+			return "", "", err
+		}
+		if internalServerURL != "" && internalCACerts != "" {
+			return internalServerURL, internalCACerts, nil
+		}
+
+		var empty []string
+		if internalServerURL == "" {
+			empty = append(empty, serverURLSetting)
+		}
+		if internalCACerts == "" {
+			empty = append(empty, caCertsSetting)
+		}
+		opts.logger().Infof("Waiting for Rancher settings %s to be configured", strings.Join(empty, " and "))
+
+		select {
+		case <-ctx.Done():
+			return "", "", fmt.Errorf("timed out waiting for settings %s to be configured: %w", strings.Join(empty, " and "), ctx.Err())
+		case <-time.After(opts.settingsInterval()):
+		}
+	}
+}
+
+func getSettingWithTimeout(ctx context.Context, client dynamic.Interface, name string, opts *Options) (string, error) {
+	ctx, cancel := opts.requestContext(ctx)
+	defer cancel()
+	return GetSetting(ctx, client, name)
+}
+
+func validateServerURL(serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("%q must use https", serverURL)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%q has no host", serverURL)
+	}
+	return nil
+}
+
+// validateCACerts checks that bundle is nothing but PEM certificates, since
+// fleet only reports an opaque TLS error for a bad apiServerCA.
+func validateCACerts(bundle string) error {
+	if !strings.HasPrefix(strings.TrimSpace(bundle), "-----BEGIN ") {
+		return fmt.Errorf("unexpected data before the first PEM block")
+	}
+	_, err := cacerts.ParseBundle([]byte(bundle))
 	return err
 }
+
+// normalizeCACerts strips CRLF line endings and makes sure the PEM ends with a
+// newline, since both break apiServerCA consumers.
+func normalizeCACerts(bundle string) (string, error) {
+	bundle = strings.ReplaceAll(bundle, "\r", "")
+	if !strings.HasSuffix(bundle, "\n") {
+		bundle += "\n"
+	}
+
+	if block, _ := pem.Decode([]byte(bundle)); block == nil {
+		return "", fmt.Errorf("no PEM data found")
+	}
+	return bundle, nil
+}
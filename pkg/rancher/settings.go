@@ -0,0 +1,89 @@
+package rancher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+)
+
+var settingsResource = schema.GroupVersionResource{
+	Group:    "management.cattle.io",
+	Version:  "v3",
+	Resource: "settings",
+}
+
+// GetSetting returns the value of a Rancher setting. A missing or null value,
+// as seen right after the setting is created, is returned as empty.
+func GetSetting(ctx context.Context, client dynamic.Interface, name string) (string, error) {
+	setting, err := client.Resource(settingsResource).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	value := setting.Object["value"]
+	if value == nil {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("value of setting %s is a %T, not a string", name, value)
+	}
+	return s, nil
+}
+
+// SetSetting sets the value of an existing Rancher setting.
+func SetSetting(ctx context.Context, client dynamic.Interface, name, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"value": value,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Resource(settingsResource).Patch(ctx, name, types.MergePatchType, patch, v1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("setting %s: %w", name, err)
+	}
+	return nil
+}
+
+// WaitForSettingsCRD polls the discovery API until the settings resource of
+// Rancher is served, which it isn't until Rancher registered its CRDs.
+func WaitForSettingsCRD(ctx context.Context, client discovery.DiscoveryInterface, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return waitForSettingsCRD(ctx, client, DefaultSettingsInterval, logrus.StandardLogger())
+}
+
+// waitForSettingsCRD is WaitForSettingsCRD polling every interval until ctx is
+// done.
+func waitForSettingsCRD(ctx context.Context, client discovery.DiscoveryInterface, interval time.Duration, logger *logrus.Logger) error {
+	groupVersion := settingsResource.GroupVersion().String()
+	for {
+		resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+		if err == nil {
+			for _, resource := range resources.APIResources {
+				if resource.Name == settingsResource.Resource {
+					return nil
+				}
+			}
+		} else if !apierrors.IsNotFound(err) {
+			logger.Debugf("Discovering %s: %v", groupVersion, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for resource %s in %s to be served: %w", settingsResource.Resource, groupVersion, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
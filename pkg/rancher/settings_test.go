@@ -0,0 +1,67 @@
+package rancher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestGetSetting(t *testing.T) {
+	missingValue := newTestSetting("missing-value", nil)
+	delete(missingValue.Object, "value")
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestSetting("string", testServerURL),
+		newTestSetting("empty", ""),
+		newTestSetting("null", nil),
+		missingValue,
+		newTestSetting("number", int64(443)),
+		newTestSetting("object", map[string]interface{}{"url": testServerURL}),
+	)
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "string", want: testServerURL},
+		{name: "empty"},
+		{name: "null"},
+		{name: "missing-value"},
+		{name: "number", wantErr: true},
+		{name: "object", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetSetting(context.Background(), client, tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetSetting(%s) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetSetting(%s) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := GetSetting(context.Background(), client, "missing"); !apierrors.IsNotFound(err) {
+		t.Errorf("GetSetting(missing) error = %v, want NotFound", err)
+	}
+}
+
+func TestUpdateClientSecretWaitsForNullSetting(t *testing.T) {
+	opts, k8s := newTestOptions(newTestSecret(nil),
+		newTestSetting(rancherSettingInternalServerURL, testServerURL),
+		newTestSetting(rancherSettingInternalCACerts, nil))
+	opts.SettingsTimeout = 100 * time.Millisecond
+
+	if err := UpdateClientSecret(context.Background(), opts); err == nil {
+		t.Fatal("UpdateClientSecret() succeeded without a value for internal-cacerts")
+	}
+	if updates := secretUpdates(k8s); updates != 0 {
+		t.Errorf("secret updated %d times without a value for internal-cacerts", updates)
+	}
+}
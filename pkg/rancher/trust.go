@@ -0,0 +1,114 @@
+package rancher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"sort"
+
+	"k8s.io/client-go/dynamic"
+
+	"github.com/rancher/rancherd/pkg/cacerts"
+)
+
+// ClusterTrustReport compares the CA recorded in the internal-cacerts setting
+// with the CA the server actually serves through the cacerts handshake.
+type ClusterTrustReport struct {
+	Server              string   `json:"server"`
+	SettingFingerprints []string `json:"settingFingerprints"`
+	ServedFingerprints  []string `json:"servedFingerprints"`
+	ServedChecksum      string   `json:"servedChecksum,omitempty"`
+	// AlreadyTrusted is set when the server is trusted by the system roots and
+	// served no CA at all.
+	AlreadyTrusted bool `json:"alreadyTrusted"`
+	Match          bool `json:"match"`
+}
+
+// VerifyClusterTrust checks that the internal-cacerts setting of the cluster
+// holds the same certificates, by SHA-256 fingerprint, as the CA downloaded
+// from server. A mismatch is reported in the result rather than as an error.
+func VerifyClusterTrust(ctx context.Context, opts *Options, server, token string) (*ClusterTrustReport, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	client := opts.Dynamic
+	if client == nil {
+		conf, err := restConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		if client, err = dynamic.NewForConfig(conf); err != nil {
+			return nil, err
+		}
+	}
+
+	internalCACerts, err := getSettingWithTimeout(ctx, client, opts.caCertsSetting(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cacerts.CACertsResult(ctx, server, token, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	served := result.CACert
+
+	report := &ClusterTrustReport{
+		Server:         server,
+		ServedChecksum: result.Checksum,
+		AlreadyTrusted: result.AlreadyTrusted,
+	}
+
+	report.SettingFingerprints, err = certFingerprints([]byte(internalCACerts))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s setting: %w", opts.caCertsSetting(), err)
+	}
+	report.ServedFingerprints, err = certFingerprints(served)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cacerts from %s: %w", server, err)
+	}
+
+	report.Match = equalStrings(report.SettingFingerprints, report.ServedFingerprints)
+	return report, nil
+}
+
+// certFingerprints returns the sorted, deduplicated SHA-256 fingerprints of the
+// DER of every certificate in the PEM bundle.
+func certFingerprints(bundle []byte) ([]string, error) {
+	seen := map[string]bool{}
+	result := []string{}
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+
+		sum := sha256.Sum256(block.Bytes)
+		fingerprint := hex.EncodeToString(sum[:])
+		if !seen[fingerprint] {
+			seen[fingerprint] = true
+			result = append(result, fingerprint)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func equalStrings(left, right []string) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for i := range left {
+		if left[i] != right[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -58,7 +58,7 @@ func (r *Rancherd) Info(ctx context.Context) error {
 }
 
 func (r *Rancherd) Upgrade(ctx context.Context, upgradeConfig UpgradeConfig) error {
-	cfg, err := config.Load(r.cfg.ConfigPath)
+	cfg, err := config.Load(ctx, r.cfg.ConfigPath)
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
@@ -143,7 +143,7 @@ func (r *Rancherd) Upgrade(ctx context.Context, upgradeConfig UpgradeConfig) err
 }
 
 func (r *Rancherd) execute(ctx context.Context) error {
-	cfg, err := config.Load(r.cfg.ConfigPath)
+	cfg, err := config.Load(ctx, r.cfg.ConfigPath)
 	if err != nil {
 		return fmt.Errorf("loading config: %w", err)
 	}
@@ -1,6 +1,7 @@
 package tpm
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -16,7 +17,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func Get(cacerts []byte, url string, header http.Header) ([]byte, error) {
+func Get(ctx context.Context, cacerts []byte, url string, header http.Header) ([]byte, error) {
 	dialer := websocket.DefaultDialer
 	if len(cacerts) > 0 {
 		pool := x509.NewCertPool()
@@ -30,12 +31,19 @@ func Get(cacerts []byte, url string, header http.Header) ([]byte, error) {
 		}
 	}
 
-	attestationData, aikBytes, err := getAttestationData()
-	if err != nil {
-		return nil, err
-	}
-
-	hash, err := GetPubHash()
+	var (
+		attestationData *AttestationData
+		aikBytes        []byte
+		hash            string
+	)
+	err := withContext(ctx, func() (err error) {
+		attestationData, aikBytes, err = getAttestationData()
+		if err != nil {
+			return err
+		}
+		hash, err = GetPubHash()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -51,17 +59,24 @@ func Get(cacerts []byte, url string, header http.Header) ([]byte, error) {
 	header.Add("Authorization", token)
 	wsURL := strings.Replace(url, "http", "ws", 1)
 	logrus.Infof("Using TPMHash %s to dial %s", hash, wsURL)
-	conn, resp, err := dialer.Dial(wsURL, header)
+	conn, resp, err := dialer.DialContext(ctx, wsURL, header)
 	if err != nil {
-		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
-			data, err := ioutil.ReadAll(resp.Body)
-			if err == nil {
-				return nil, errors.New(string(data))
+		if resp != nil {
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusUnauthorized {
+				data, err := ioutil.ReadAll(resp.Body)
+				if err == nil {
+					return nil, errors.New(string(data))
+				}
 			}
 		}
 		return nil, err
 	}
 	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+		_ = conn.SetWriteDeadline(deadline)
+	}
 
 	_, msg, err := conn.NextReader()
 	if err != nil {
@@ -73,7 +88,11 @@ func Get(cacerts []byte, url string, header http.Header) ([]byte, error) {
 		return nil, fmt.Errorf("unmarshaling Challenge: %w", err)
 	}
 
-	challengeResp, err := getChallengeResponse(challenge.EC, aikBytes)
+	var challengeResp *ChallengeResponse
+	err = withContext(ctx, func() (err error) {
+		challengeResp, err = getChallengeResponse(challenge.EC, aikBytes)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
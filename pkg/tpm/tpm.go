@@ -1,21 +1,86 @@
 package tpm
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/google/go-attestation/attest"
 )
 
+var (
+	resolvedTokensLock sync.Mutex
+	// resolvedTokens only lives in memory so resolved hashes never outlive the process
+	resolvedTokens = map[string]string{}
+)
+
+// ResolveToken replaces a tpm:// token with the hash of the EK of the TPM.
 func ResolveToken(token string) (bool, string, error) {
+	return ResolveTokenContext(context.Background(), token)
+}
+
+// ResolveTokenContext is ResolveToken giving up on the TPM once ctx is done.
+func ResolveTokenContext(ctx context.Context, token string) (bool, string, error) {
 	if !strings.HasPrefix(token, "tpm://") {
 		return false, token, nil
 	}
 
-	hash, err := GetPubHash()
-	return true, hash, err
+	resolvedTokensLock.Lock()
+	hash, ok := resolvedTokens[token]
+	resolvedTokensLock.Unlock()
+	if ok {
+		return true, hash, nil
+	}
+
+	// The lock isn't held while waiting for the TPM so a call that timed out
+	// doesn't block the next ones
+	err := withContext(ctx, func() (err error) {
+		hash, err = GetPubHash()
+		return err
+	})
+	if err != nil {
+		return true, "", err
+	}
+
+	resolvedTokensLock.Lock()
+	defer resolvedTokensLock.Unlock()
+	resolvedTokens[token] = hash
+	return true, hash, nil
+}
+
+// withContext runs f, which talks to the TPM, and returns early with an error
+// if ctx is done first. The TPM calls can't be interrupted, so f keeps running
+// in the background until the TPM answers.
+func withContext(ctx context.Context, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("TPM did not respond: %w", ctx.Err())
+	}
+}
+
+// InvalidateTokenCache drops every token resolved by ResolveToken so the next
+// call goes back to the TPM.
+func InvalidateTokenCache() {
+	resolvedTokensLock.Lock()
+	defer resolvedTokensLock.Unlock()
+	resolvedTokens = map[string]string{}
+}
+
+// IsNotAvailable tells if err was caused by the node having no TPM 2.0 device,
+// as opposed to a TPM that is present but failing.
+func IsNotAvailable(err error) bool {
+	return errors.Is(err, attest.ErrTPMNotAvailable)
 }
 
 func GetPubHash() (string, error) {